@@ -0,0 +1,53 @@
+package xerrs
+
+import "errors"
+
+// classifiedError tells whether retrying the operation that produced the error has any chance to succeed.
+//
+// There is deliberately no sentinel to match with errors.Is: it would find any classification of the chain,
+// while only the outermost one counts. Use IsPermanent and IsTransient instead.
+type classifiedError struct {
+	err       error
+	permanent bool
+}
+
+func (e *classifiedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classifiedError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks the error as one that retrying won't fix, such as an invalid input.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{err: err, permanent: true}
+}
+
+// Transient marks the error as one that may go away by retrying, such as a network failure.
+//
+// Unclassified errors are already considered transient, this is only useful to override
+// the classification of a wrapped error.
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{err: err, permanent: false}
+}
+
+// IsPermanent tells whether the error is permanent. The outermost classification of the chain wins.
+func IsPermanent(err error) bool {
+	var classified *classifiedError
+	if !errors.As(err, &classified) {
+		return false
+	}
+	return classified.permanent
+}
+
+// IsTransient tells whether the error is worth retrying, which is the case of any unclassified error.
+func IsTransient(err error) bool {
+	return err != nil && !IsPermanent(err)
+}
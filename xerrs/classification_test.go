@@ -0,0 +1,39 @@
+package xerrs_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/raphoester/x/xerrs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassification(t *testing.T) {
+	base := errors.New("base")
+
+	tests := []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{name: "unclassified", err: base, permanent: false},
+		{name: "permanent", err: xerrs.Permanent(base), permanent: true},
+		{name: "wrapped permanent", err: fmt.Errorf("context: %w", xerrs.Permanent(base)), permanent: true},
+		{name: "transient override", err: xerrs.Transient(fmt.Errorf("context: %w", xerrs.Permanent(base))), permanent: false},
+		{name: "permanent override", err: xerrs.Permanent(fmt.Errorf("context: %w", xerrs.Transient(base))), permanent: true},
+		{name: "wrapped transient override", err: fmt.Errorf("outer: %w", xerrs.Transient(xerrs.Permanent(base))), permanent: false},
+		{name: "nested overrides", err: xerrs.Permanent(xerrs.Transient(fmt.Errorf("context: %w", xerrs.Permanent(base)))), permanent: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.permanent, xerrs.IsPermanent(tt.err))
+			assert.Equal(t, !tt.permanent, xerrs.IsTransient(tt.err))
+			assert.ErrorIs(t, tt.err, base)
+		})
+	}
+
+	assert.Nil(t, xerrs.Permanent(nil))
+	assert.False(t, xerrs.IsTransient(nil))
+}
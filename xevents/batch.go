@@ -0,0 +1,82 @@
+package xevents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// BatchPublisher is implemented by the publishers able to publish several events at once
+// more efficiently than one at a time.
+type BatchPublisher interface {
+	// PublishBatch publishes the events. A batch is not atomic: when only some of the events failed,
+	// the returned error is a *BatchError telling which ones. Any other error means that none was published.
+	PublishBatch(ctx context.Context, events ...*Event) error
+}
+
+// BatchError lists the events of a batch that failed to be published, by ID.
+type BatchError struct {
+	Errors map[string]error
+}
+
+func (e *BatchError) Error() string {
+	ids := make([]string, 0, len(e.Errors))
+	for id := range e.Errors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, fmt.Sprintf("%s: %s", id, e.Errors[id]))
+	}
+
+	return fmt.Sprintf("failed to publish %d events of the batch: %s", len(ids), strings.Join(parts, "; "))
+}
+
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// PublishAll publishes the events as a batch if the publisher supports it, one by one otherwise.
+//
+// It returns the IDs of the events that were published, along with the error of the others.
+func PublishAll(ctx context.Context, publisher Publisher, events ...*Event) ([]string, error) {
+	var err error
+	if batchPublisher, ok := publisher.(BatchPublisher); ok {
+		err = batchPublisher.PublishBatch(ctx, events...)
+	} else {
+		failed := make(map[string]error)
+		for _, event := range events {
+			if err := publisher.Publish(ctx, event); err != nil {
+				failed[event.Data().ID] = err
+			}
+		}
+		if len(failed) > 0 {
+			err = &BatchError{Errors: failed}
+		}
+	}
+
+	var batchErr *BatchError
+	if err != nil && !errors.As(err, &batchErr) {
+		return nil, err
+	}
+
+	published := make([]string, 0, len(events))
+	for _, event := range events {
+		if batchErr != nil {
+			if _, ok := batchErr.Errors[event.Data().ID]; ok {
+				continue
+			}
+		}
+		published = append(published, event.Data().ID)
+	}
+
+	return published, err
+}
@@ -0,0 +1,85 @@
+package xevents_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xid"
+	"github.com/raphoester/x/xtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingPublisher fails to publish the events whose payload key is "fail".
+type failingPublisher struct {
+	published []string
+}
+
+func (p *failingPublisher) Publish(_ context.Context, event *xevents.Event) error {
+	if event.Data().Payload.(xevents.ExamplePayload).Key == "fail" {
+		return errors.New("failure")
+	}
+	p.published = append(p.published, event.Data().ID)
+	return nil
+}
+
+type failingBatchPublisher struct {
+	failingPublisher
+	batches int
+}
+
+func (p *failingBatchPublisher) PublishBatch(ctx context.Context, events ...*xevents.Event) error {
+	p.batches++
+	failed := make(map[string]error)
+	for _, event := range events {
+		if err := p.Publish(ctx, event); err != nil {
+			failed[event.Data().ID] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &xevents.BatchError{Errors: failed}
+	}
+	return nil
+}
+
+func newEvents(t *testing.T, keys ...string) []*xevents.Event {
+	events := make([]*xevents.Event, 0, len(keys))
+	for _, key := range keys {
+		event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: key})
+		require.NoError(t, err)
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestPublishAll(t *testing.T) {
+	events := newEvents(t, "ok", "fail", "ok")
+
+	t.Run("one by one", func(t *testing.T) {
+		publisher := &failingPublisher{}
+		published, err := xevents.PublishAll(context.Background(), publisher, events...)
+
+		var batchErr *xevents.BatchError
+		require.ErrorAs(t, err, &batchErr)
+		assert.Contains(t, batchErr.Errors, events[1].Data().ID)
+		assert.Equal(t, []string{events[0].Data().ID, events[2].Data().ID}, published)
+		assert.Equal(t, published, publisher.published)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		publisher := &failingBatchPublisher{}
+		published, err := xevents.PublishAll(context.Background(), publisher, events...)
+
+		assert.Error(t, err)
+		assert.Equal(t, 1, publisher.batches)
+		assert.Equal(t, []string{events[0].Data().ID, events[2].Data().ID}, published)
+	})
+
+	t.Run("success", func(t *testing.T) {
+		published, err := xevents.PublishAll(context.Background(), &failingBatchPublisher{}, events[0], events[2])
+		assert.NoError(t, err)
+		assert.Len(t, published, 2)
+	})
+}
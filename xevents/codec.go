@@ -0,0 +1,178 @@
+package xevents
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"reflect"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeCBOR     = "application/cbor"
+	ContentTypeMsgpack  = "application/msgpack"
+)
+
+// Codec encodes and decodes event payloads for one content type.
+type Codec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, to any) error
+}
+
+// ContentTyped can be implemented by payloads that should not be encoded with the default codec.
+//
+// Payloads implementing proto.Message don't need it, they are encoded with protobuf by default.
+type ContentTyped interface {
+	ContentType() string
+}
+
+func NewCodecRegistry(codecs ...Codec) *CodecRegistry {
+	r := &CodecRegistry{codecs: make(map[string]Codec, len(codecs))}
+	r.Register(codecs...)
+	return r
+}
+
+// CodecRegistry maps content types to the codec in charge of them.
+type CodecRegistry struct {
+	mu     sync.RWMutex
+	codecs map[string]Codec
+}
+
+// Register adds the codecs to the registry, replacing any codec already registered for the same content type.
+func (r *CodecRegistry) Register(codecs ...Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, codec := range codecs {
+		r.codecs[normalizeContentType(codec.ContentType())] = codec
+	}
+}
+
+// Get returns the codec registered for the content type.
+//
+// An empty content type is considered JSON, which was the only format before codecs were introduced.
+func (r *CodecRegistry) Get(contentType string) (Codec, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	codec, ok := r.codecs[normalizeContentType(contentType)]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for content type %q", contentType)
+	}
+
+	return codec, nil
+}
+
+var defaultCodecs = NewCodecRegistry(
+	JSONCodec{},
+	ProtobufCodec{},
+	CBORCodec{},
+	MsgpackCodec{},
+)
+
+// DefaultCodecs returns the registry used by events to encode and decode their payloads.
+func DefaultCodecs() *CodecRegistry {
+	return defaultCodecs
+}
+
+// RegisterCodec makes a custom codec available to every event, publisher and listener.
+func RegisterCodec(codecs ...Codec) {
+	defaultCodecs.Register(codecs...)
+}
+
+func normalizeContentType(contentType string) string {
+	if contentType == "" {
+		return ContentTypeJSON
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+
+	return mediaType
+}
+
+// IsJSON tells whether the content type designates JSON-encoded payloads.
+func IsJSON(contentType string) bool {
+	return normalizeContentType(contentType) == ContentTypeJSON
+}
+
+// ContentTypeOf returns the content type a value is encoded with: the one it declares (see ContentTyped),
+// protobuf for protobuf messages, JSON otherwise.
+func ContentTypeOf(v any) string {
+	if typed, ok := v.(ContentTyped); ok {
+		return typed.ContentType()
+	}
+
+	if _, ok := v.(proto.Message); ok {
+		return ContentTypeProtobuf
+	}
+
+	return ContentTypeJSON
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string { return ContentTypeJSON }
+
+func (JSONCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec) Unmarshal(data []byte, to any) error { return json.Unmarshal(data, to) }
+
+type ProtobufCodec struct{}
+
+var protoMessageType = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+func (ProtobufCodec) ContentType() string { return ContentTypeProtobuf }
+
+func (ProtobufCodec) Marshal(v any) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T does not implement proto.Message", v)
+	}
+	return proto.Marshal(msg)
+}
+
+// Unmarshal accepts either a proto.Message or a pointer to one, which is allocated if nil.
+//
+// The latter is what UnmarshalHelper passes for payload types such as *pb.SomeEvent.
+func (ProtobufCodec) Unmarshal(data []byte, to any) error {
+	if msg, ok := to.(proto.Message); ok {
+		return proto.Unmarshal(data, msg)
+	}
+
+	rv := reflect.ValueOf(to)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Pointer || !rv.Elem().Type().Implements(protoMessageType) {
+		return fmt.Errorf("%T does not implement proto.Message", to)
+	}
+
+	if rv.Elem().IsNil() {
+		rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+	}
+
+	return proto.Unmarshal(data, rv.Elem().Interface().(proto.Message))
+}
+
+type CBORCodec struct{}
+
+func (CBORCodec) ContentType() string { return ContentTypeCBOR }
+
+func (CBORCodec) Marshal(v any) ([]byte, error) { return cbor.Marshal(v) }
+
+func (CBORCodec) Unmarshal(data []byte, to any) error { return cbor.Unmarshal(data, to) }
+
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) ContentType() string { return ContentTypeMsgpack }
+
+func (MsgpackCodec) Marshal(v any) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (MsgpackCodec) Unmarshal(data []byte, to any) error { return msgpack.Unmarshal(data, to) }
@@ -0,0 +1,90 @@
+package xevents_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xid"
+	"github.com/raphoester/x/xtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type codecPayload struct {
+	Key   string `json:"key" cbor:"key" msgpack:"key"`
+	Count int    `json:"count" cbor:"count" msgpack:"count"`
+
+	contentType string
+}
+
+func (p codecPayload) Topic() string       { return "codec" }
+func (p codecPayload) IsValid() bool       { return true }
+func (p codecPayload) ContentType() string { return p.contentType }
+
+func TestCodecsRoundTrip(t *testing.T) {
+	contentTypes := []string{
+		xevents.ContentTypeJSON,
+		xevents.ContentTypeCBOR,
+		xevents.ContentTypeMsgpack,
+	}
+
+	for _, contentType := range contentTypes {
+		t.Run(contentType, func(t *testing.T) {
+			sent := codecPayload{Key: "value", Count: 42, contentType: contentType}
+			event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.NewDefaultFixedGenerator(), sent)
+			require.NoError(t, err)
+			require.Equal(t, contentType, event.Data().ContentType)
+
+			body, err := event.MarshalPayload()
+			require.NoError(t, err)
+
+			// simulate a delivery coming from the wire
+			restored := xevents.Restore(
+				event.Data().ID,
+				event.Data().CreatedAt,
+				event.Data().Topic,
+				body,
+				xevents.WithContentType(contentType),
+			)
+
+			var received codecPayload
+			err = xevents.UnmarshalHelper(func(_ context.Context, _ *xevents.Event, payload codecPayload) error {
+				received = payload
+				return nil
+			})(context.Background(), restored)
+			require.NoError(t, err)
+
+			assert.Equal(t, sent.Key, received.Key)
+			assert.Equal(t, sent.Count, received.Count)
+		})
+	}
+}
+
+func TestProtobufCodecAllocatesPointerTargets(t *testing.T) {
+	codec, err := xevents.DefaultCodecs().Get(xevents.ContentTypeProtobuf)
+	require.NoError(t, err)
+
+	body, err := codec.Marshal(wrapperspb.String("value"))
+	require.NoError(t, err)
+
+	var msg *wrapperspb.StringValue
+	require.NoError(t, codec.Unmarshal(body, &msg))
+	assert.Equal(t, "value", msg.GetValue())
+}
+
+func TestCodecRegistryNormalizesContentType(t *testing.T) {
+	registry := xevents.NewCodecRegistry(xevents.JSONCodec{})
+
+	codec, err := registry.Get("application/json; charset=utf-8")
+	require.NoError(t, err)
+	assert.Equal(t, xevents.ContentTypeJSON, codec.ContentType())
+
+	codec, err = registry.Get("")
+	require.NoError(t, err)
+	assert.Equal(t, xevents.ContentTypeJSON, codec.ContentType())
+
+	_, err = registry.Get(xevents.ContentTypeCBOR)
+	assert.Error(t, err)
+}
@@ -2,16 +2,21 @@ package xevents
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/raphoester/x/xid"
 	"github.com/raphoester/x/xtime"
 )
 
+// New creates an event from its payload.
+//
+// The event's metadata is taken from the context (see ContextWithMetadata).
+// An event created outside any chain starts its own: its correlation ID is its own ID.
 func New(
+	ctx context.Context,
 	timeProvider xtime.Provider,
 	idGenerator xid.Generator,
 	p Payload,
@@ -19,12 +24,27 @@ func New(
 	if !p.IsValid() {
 		return nil, errors.New("invalid payload")
 	}
+
+	id := idGenerator.Generate()
+	metadata := MetadataFromContext(ctx)
+	if metadata.CorrelationID() == "" {
+		metadata[MetadataCorrelationID] = id
+	}
+
+	delete(metadata, MetadataOrderingKey)
+	if key := orderingKeyOf(p); key != "" {
+		metadata[MetadataOrderingKey] = key
+	}
+
 	return &Event{
 		content: EventData{
-			ID:        idGenerator.Generate(),
-			CreatedAt: timeProvider.Now(),
-			Topic:     p.Topic(),
-			Payload:   p,
+			ID:            id,
+			CreatedAt:     timeProvider.Now(),
+			Topic:         p.Topic(),
+			Payload:       p,
+			ContentType:   ContentTypeOf(p),
+			SchemaVersion: schemaVersionOf(p),
+			Metadata:      metadata,
 		},
 	}, nil
 }
@@ -36,22 +56,55 @@ type Event struct {
 // Restore offers a way to recreate an Event from its raw data.
 //
 // Payload is of any type to allow raw-feeding []bytes or any other type that doesn't necessarily implement Payload.
-// The only constraint is that it should be json-unmarshal-able to the final concrete struct type
-// that is passed to UnmarshalPayload.
+// The only constraint is that it should be decodable by the codec of the event's content type (JSON unless
+// WithContentType is given) to the final concrete struct type that is passed to UnmarshalPayload.
 func Restore(
 	id string,
 	createdAt time.Time,
 	topic string,
 	payload any,
+	opts ...RestoreOption,
 ) *Event {
-	return &Event{
+	event := &Event{
 		content: EventData{
-			ID:        id,
-			CreatedAt: createdAt,
-			Topic:     topic,
-			Payload:   payload,
+			ID:            id,
+			CreatedAt:     createdAt,
+			Topic:         topic,
+			Payload:       payload,
+			SchemaVersion: initialSchemaVersion,
+			Metadata:      Metadata{},
 		},
 	}
+
+	for _, opt := range opts {
+		opt(&event.content)
+	}
+
+	return event
+}
+
+// RestoreOption sets the optional parts of an event being restored.
+type RestoreOption func(*EventData)
+
+func WithMetadata(metadata Metadata) RestoreOption {
+	return func(data *EventData) {
+		data.Metadata = metadata.Clone()
+	}
+}
+
+func WithContentType(contentType string) RestoreOption {
+	return func(data *EventData) {
+		data.ContentType = contentType
+	}
+}
+
+// WithSchemaVersion sets the version the payload was written with. Versions lower than 1 are ignored.
+func WithSchemaVersion(version int) RestoreOption {
+	return func(data *EventData) {
+		if version >= initialSchemaVersion {
+			data.SchemaVersion = version
+		}
+	}
 }
 
 func (e *Event) Data() EventData {
@@ -59,10 +112,16 @@ func (e *Event) Data() EventData {
 }
 
 type EventData struct {
-	ID        string
-	CreatedAt time.Time
-	Topic     string
-	Payload   any
+	ID            string
+	CreatedAt     time.Time
+	Topic         string
+	Payload       any
+	ContentType   string
+	SchemaVersion int
+	Metadata      Metadata
+
+	// DeliverAfter is the time before which the event is not delivered, zero means right away (see DelayedUntil).
+	DeliverAfter time.Time
 }
 
 type Payload interface {
@@ -70,14 +129,45 @@ type Payload interface {
 	IsValid() bool
 }
 
+func (e *Event) codec() (Codec, error) {
+	return defaultCodecs.Get(e.content.ContentType)
+}
+
+// MarshalPayload encodes the payload with the codec of the event's content type.
+//
+// Raw payloads (restored from []byte) are returned untouched.
 func (e *Event) MarshalPayload() ([]byte, error) {
-	return json.Marshal(e.content.Payload)
+	if b, ok := e.content.Payload.([]byte); ok {
+		return b, nil
+	}
+
+	codec, err := e.codec()
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.Marshal(e.content.Payload)
 }
 
 func (e *Event) UnmarshalPayload(to any) error {
+	// payloads already decoded to the target type (see TopicRegistry) are handed over as-is
+	if target := reflect.ValueOf(to); e.content.Payload != nil && target.Kind() == reflect.Pointer && !target.IsNil() {
+		_, raw := e.content.Payload.([]byte)
+		payload := reflect.ValueOf(e.content.Payload)
+		if !raw && target.Elem().Kind() != reflect.Interface && payload.Type().AssignableTo(target.Elem().Type()) {
+			target.Elem().Set(payload)
+			return nil
+		}
+	}
+
+	codec, err := e.codec()
+	if err != nil {
+		return err
+	}
+
 	b, ok := e.content.Payload.([]byte)
 	if ok {
-		if err := json.Unmarshal(b, &to); err != nil {
+		if err := codec.Unmarshal(b, to); err != nil {
 			return fmt.Errorf("failed unmarshalling payload: %w", err)
 		}
 
@@ -87,12 +177,12 @@ func (e *Event) UnmarshalPayload(to any) error {
 	// if the payload is not a slice of bytes, we assume it's already under the form of a struct
 	//
 	// we then need to marshal it to []byte to be able to unmarshal it to the target type
-	b, err := json.Marshal(e.content.Payload)
+	b, err = codec.Marshal(e.content.Payload)
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(b, &to)
+	return codec.Unmarshal(b, to)
 }
 
 type Publisher interface {
@@ -100,7 +190,14 @@ type Publisher interface {
 }
 
 type Listener interface {
-	Listen(ctx context.Context, identifier string, routingKeys []string, pairs ...HandlerPair) error
+	Listen(ctx context.Context, identifier string, routingKeys []string, pairs []HandlerPair, opts ...ListenOption) (Subscription, error)
+}
+
+// Subscription is returned by Listen, cancelling the context given to Listen stops it as well.
+type Subscription interface {
+	// Stop stops receiving events and waits for the handlers being run to return,
+	// until the context is done. It returns the error that made the subscription fail, if any.
+	Stop(ctx context.Context) error
 }
 
 type HandlerPair struct {
@@ -4,10 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+
+	"github.com/raphoester/x/xerrs"
 )
 
 // UnmarshalHelper is a utility function that allows the handler NOT to care about any of the unmarshalling logic.
 //
+// The payload is brought to the latest schema version of its topic by the upcasters of the default registry.
+// Payloads that can't be decoded fail with a permanent error (see xerrs.Permanent), as retrying won't help.
+//
 // Example usage:
 //
 //	func exampleUsage() {
@@ -24,13 +29,18 @@ import (
 //	}
 func UnmarshalHelper[P Payload](fn func(ctx context.Context, event *Event, payload P) error) func(ctx context.Context, event *Event) error {
 	return func(ctx context.Context, event *Event) error {
+		event, err := defaultTopics.Upcast(event)
+		if err != nil {
+			return xerrs.Permanent(fmt.Errorf("failed upcasting payload: %w", err))
+		}
+
 		var payload P
 		if err := event.UnmarshalPayload(&payload); err != nil {
-			return fmt.Errorf("failed unmarshaling payload to %T: %w", payload, err)
+			return xerrs.Permanent(fmt.Errorf("failed unmarshaling payload to %T: %w", payload, err))
 		}
 
 		if !payload.IsValid() {
-			return errors.New("unmarshalled payload is invalid")
+			return xerrs.Permanent(errors.New("unmarshalled payload is invalid"))
 		}
 
 		return fn(ctx, event, payload)
@@ -0,0 +1,195 @@
+package xevents
+
+import "time"
+
+// ListenOptions tune a subscription made with Listener.Listen. Brokers ignore the options that don't apply to them.
+type ListenOptions struct {
+	// Concurrency is the number of handlers of the subscription that can run at the same time.
+	// Zero lets the broker decide.
+	Concurrency int
+
+	// Prefetch is the number of events a consumer can receive before handling them. Zero means no limit.
+	Prefetch int
+
+	// Partitions splits the subscription in as many consumers, each handling one event at a time.
+	// The events sharing an ordering key (see Ordered) are always given to the same partition, in publish order.
+	// Zero or one means the subscription is not partitioned.
+	Partitions int
+
+	Queue QueueOptions
+
+	Replay ReplayOptions
+}
+
+// ReplayOptions make a subscription consume a log of events rather than a queue: handled events are kept,
+// so that a new subscription can read the events published before it, to rebuild a projection for example.
+//
+// A replayable subscription is handled by a single consumer, the brokers without logs ignore it.
+//
+// Events are handled in log order, so an event whose handler fails with a transient error stops the subscription:
+// the following events wait while it is retried, if the broker has a retry policy. Once the attempts are
+// exhausted, or right away for permanent errors, it is dead-lettered.
+type ReplayOptions struct {
+	Enabled bool
+
+	// From is where the subscription starts reading the log.
+	From ReplayPosition
+
+	// Checkpoint names the position of the subscription in the log, saved by the broker while handling events.
+	// A subscription with the same checkpoint resumes right after the last event handled, rather than at From.
+	Checkpoint string
+
+	// MaxAge is how long the log keeps the events. Zero means forever.
+	MaxAge time.Duration
+}
+
+type ReplayKind string
+
+const (
+	// ReplayNext skips the events already in the log.
+	ReplayNext  ReplayKind = "next"
+	ReplayFirst ReplayKind = "first"
+	// ReplayLast starts at the latest events, the broker deciding how many.
+	ReplayLast   ReplayKind = "last"
+	ReplayOffset ReplayKind = "offset"
+	ReplayTime   ReplayKind = "time"
+)
+
+// ReplayPosition is a position in a log of events, the zero value being ReplayNext.
+type ReplayPosition struct {
+	Kind ReplayKind
+	// Offset is the position of the event in the log, see ReplayOffsetOf.
+	Offset int64
+	Time   time.Time
+}
+
+func ReplayFromFirst() ReplayPosition {
+	return ReplayPosition{Kind: ReplayFirst}
+}
+
+func ReplayFromLast() ReplayPosition {
+	return ReplayPosition{Kind: ReplayLast}
+}
+
+func ReplayFromNext() ReplayPosition {
+	return ReplayPosition{Kind: ReplayNext}
+}
+
+func ReplayFromOffset(offset int64) ReplayPosition {
+	return ReplayPosition{Kind: ReplayOffset, Offset: offset}
+}
+
+// ReplayFromTime starts at the first event appended to the log at the given time.
+func ReplayFromTime(t time.Time) ReplayPosition {
+	return ReplayPosition{Kind: ReplayTime, Time: t}
+}
+
+// QueueOptions are the properties of the queue a subscription consumes from.
+//
+// All the subscriptions sharing a queue must use the same queue options.
+type QueueOptions struct {
+	// Durable queues survive broker restarts.
+	Durable bool
+
+	// Quorum queues are replicated, they are always durable and can be neither exclusive nor auto-deleted.
+	Quorum bool
+
+	// Exclusive queues can only be used by the connection that declared them, and are deleted when it closes.
+	Exclusive bool
+
+	// AutoDelete queues are deleted once their last consumer stopped.
+	AutoDelete bool
+
+	// MessageTTL is how long an event can wait in the queue before being discarded. Zero means forever.
+	MessageTTL time.Duration
+
+	// MaxLength is the number of events the queue can hold, the oldest ones being discarded. Zero means no limit.
+	MaxLength int
+}
+
+type ListenOption func(*ListenOptions)
+
+func NewListenOptions(opts ...ListenOption) ListenOptions {
+	options := ListenOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	return options
+}
+
+func WithConcurrency(concurrency int) ListenOption {
+	return func(o *ListenOptions) {
+		o.Concurrency = concurrency
+	}
+}
+
+func WithPrefetch(prefetch int) ListenOption {
+	return func(o *ListenOptions) {
+		o.Prefetch = prefetch
+	}
+}
+
+func WithPartitions(partitions int) ListenOption {
+	return func(o *ListenOptions) {
+		o.Partitions = partitions
+	}
+}
+
+func WithDurableQueue() ListenOption {
+	return func(o *ListenOptions) {
+		o.Queue.Durable = true
+	}
+}
+
+func WithQuorumQueue() ListenOption {
+	return func(o *ListenOptions) {
+		o.Queue.Durable = true
+		o.Queue.Quorum = true
+	}
+}
+
+func WithExclusiveQueue() ListenOption {
+	return func(o *ListenOptions) {
+		o.Queue.Exclusive = true
+	}
+}
+
+func WithAutoDeleteQueue() ListenOption {
+	return func(o *ListenOptions) {
+		o.Queue.AutoDelete = true
+	}
+}
+
+func WithMessageTTL(ttl time.Duration) ListenOption {
+	return func(o *ListenOptions) {
+		o.Queue.MessageTTL = ttl
+	}
+}
+
+func WithMaxLength(length int) ListenOption {
+	return func(o *ListenOptions) {
+		o.Queue.MaxLength = length
+	}
+}
+
+// WithReplay makes the subscription replayable, reading the log of events from the given position.
+func WithReplay(from ReplayPosition) ListenOption {
+	return func(o *ListenOptions) {
+		o.Replay.Enabled = true
+		o.Replay.From = from
+	}
+}
+
+// WithCheckpoint makes a replayable subscription resume where the last one with the same name stopped.
+func WithCheckpoint(name string) ListenOption {
+	return func(o *ListenOptions) {
+		o.Replay.Enabled = true
+		o.Replay.Checkpoint = name
+	}
+}
+
+func WithReplayMaxAge(maxAge time.Duration) ListenOption {
+	return func(o *ListenOptions) {
+		o.Replay.MaxAge = maxAge
+	}
+}
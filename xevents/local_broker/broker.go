@@ -2,117 +2,389 @@ package local_broker
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"slices"
 	"sync"
+	"time"
 
+	"github.com/raphoester/x/xerrs"
 	"github.com/raphoester/x/xevents"
 	"github.com/raphoester/x/xlog"
 	"github.com/raphoester/x/xlog/lf"
+	"github.com/raphoester/x/xtime"
 )
 
 type Broker struct {
 	mu          sync.Mutex
-	subscribers []subscriber
+	queues      []*queue
 	quit        chan struct{}
 	closed      bool
+	synchronous bool
+	workers     int
+	working     bool
+	backlog     []delivery
+	available   *sync.Cond
+	inFlight    int
+	idle        chan struct{}
 	logger      xlog.Logger
+	topics      *xevents.TopicRegistry
+	middlewares []xevents.Middleware
+	errorHook   ErrorHook
+	clock       xtime.Provider
+	tick        time.Duration
+	wheel       *timerWheel
+	ticking     bool
 }
 
-func New(logger xlog.Logger) *Broker {
-	return &Broker{
-		subscribers: make([]subscriber, 0),
-		quit:        make(chan struct{}),
-		logger:      logger,
+func New(logger xlog.Logger, opts ...Option) *Broker {
+	b := &Broker{
+		queues:  make([]*queue, 0),
+		quit:    make(chan struct{}),
+		logger:  logger,
+		topics:  xevents.DefaultTopicRegistry(),
+		workers: defaultWorkers,
+		idle:    make(chan struct{}),
+		clock:   xtime.RealProvider{},
+		tick:    defaultTick,
 	}
+	close(b.idle)
+	b.available = sync.NewCond(&b.mu)
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	b.wheel = newTimerWheel(b.tick, b.clock.Now())
+
+	return b
 }
 
-type subscriber struct {
-	ctx      context.Context
-	handlers map[string]xevents.Handler
+// ErrClosed is returned when scheduling an event on a closed broker.
+var ErrClosed = errors.New("broker is closed")
+
+type Option func(*Broker)
+
+// ErrorHook is called with every error returned by a handler.
+//
+// There is no retry in the local broker: permanent errors (see xerrs.Permanent) are reported as such so that
+// the hook can tell the failures that may have succeeded on another attempt from the ones that never will.
+type ErrorHook func(ctx context.Context, event *xevents.Event, err error, permanent bool)
+
+func WithErrorHook(hook ErrorHook) Option {
+	return func(b *Broker) {
+		b.errorHook = hook
+	}
 }
 
-func (b *Broker) Publish(_ context.Context, event *xevents.Event) error {
-	b.mu.Lock()
-	defer b.mu.Unlock()
+// WithSynchronous makes Publish run the handlers itself, one after the other, and return their errors.
+//
+// This makes tests deterministic: once Publish returned, the event has been handled by every queue.
+func WithSynchronous() Option {
+	return func(b *Broker) {
+		b.synchronous = true
+	}
+}
 
-	if b.closed {
+const defaultWorkers = 32
+
+// WithWorkers sets how many handlers can run at the same time when the broker is asynchronous.
+// Deliveries wait in memory for a worker to be available. The workers start along with the first delivery.
+//
+// Defaults to 32.
+func WithWorkers(workers int) Option {
+	return func(b *Broker) {
+		if workers > 0 {
+			b.workers = workers
+		}
+	}
+}
+
+// WithTimeProvider sets the clock scheduled events are delivered by (see PublishAt).
+//
+// Defaults to the real time.
+func WithTimeProvider(provider xtime.Provider) Option {
+	return func(b *Broker) {
+		b.clock = provider
+	}
+}
+
+const defaultTick = 100 * time.Millisecond
+
+// WithTick sets the precision scheduled events are delivered with.
+//
+// Defaults to 100ms.
+func WithTick(tick time.Duration) Option {
+	return func(b *Broker) {
+		if tick > 0 {
+			b.tick = tick
+		}
+	}
+}
+
+// WithTopicRegistry sets the registry used to decode the payloads of published events.
+//
+// Defaults to xevents.DefaultTopicRegistry.
+func WithTopicRegistry(registry *xevents.TopicRegistry) Option {
+	return func(b *Broker) {
+		b.topics = registry
+	}
+}
+
+// WithMiddlewares wraps every handler given to Listen with the middlewares,
+// outside of the middlewares set on the handler pairs themselves.
+func WithMiddlewares(middlewares ...xevents.Middleware) Option {
+	return func(b *Broker) {
+		b.middlewares = append(b.middlewares, middlewares...)
+	}
+}
+
+// queue mimics a RabbitMQ queue: it is shared by the listeners using the same identifier,
+// receives the events matching any of their routing keys, and hands each of them to a single consumer in turn.
+//
+// Unlike a real queue, events are not kept while there is no consumer. In asynchronous mode, the message TTL
+// and max length of the queue apply to the events waiting for a worker.
+type queue struct {
+	identifier  string
+	options     xevents.QueueOptions
+	routingKeys []string
+	consumers   []*consumer
+	next        int
+	waiting     int
+}
+
+// consumer is the subscription returned by Listen.
+type consumer struct {
+	broker      *Broker
+	queue       *queue
+	ctx         context.Context
+	handlers    map[string]xevents.Handler
+	concurrency int
+	active      int
+	partitions  int
+	busy        map[int]bool
+	stopped     bool
+	running     sync.WaitGroup
+}
+
+// Stop stops giving events to the consumer and waits for its handlers to return,
+// including the ones of the events waiting for a worker.
+func (c *consumer) Stop(ctx context.Context) error {
+	c.broker.mu.Lock()
+	c.stopped = true
+	if c.queue != nil {
+		c.broker.prune(c.queue)
+	}
+	c.broker.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
 		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to wait for running handlers: %w", ctx.Err())
 	}
+}
 
-	b.logger.Debug("publishing event",
-		lf.String("topic", event.Data().Topic),
-	)
+func (q *queue) bind(routingKeys []string) {
+	for _, key := range routingKeys {
+		if !slices.Contains(q.routingKeys, key) {
+			q.routingKeys = append(q.routingKeys, key)
+		}
+	}
+}
+
+// nextConsumer picks the consumers in a round-robin fashion.
+func (q *queue) nextConsumer() *consumer {
+	if len(q.consumers) == 0 {
+		return nil
+	}
+
+	c := q.consumers[q.next%len(q.consumers)]
+	q.next = (q.next + 1) % len(q.consumers)
+	return c
+}
+
+// Publish hands the event to one consumer of every queue it is routed to.
+//
+// In synchronous mode, the handlers have run when Publish returns, and their errors are joined in the returned error.
+// Otherwise, they are run by the workers and their errors are only logged and given to the error hook.
+//
+// Events delayed with xevents.Event.DelayedUntil are scheduled, see PublishAt.
+func (b *Broker) Publish(ctx context.Context, event *xevents.Event) error {
+	if deliverAfter := event.Data().DeliverAfter; deliverAfter.After(b.clock.Now()) {
+		return b.PublishAt(ctx, event, deliverAfter)
+	}
+
+	return b.publish(ctx, event)
+}
+
+func (b *Broker) publish(_ context.Context, event *xevents.Event) error {
+	deliveries, err := b.route(event)
+	if err != nil {
+		return err
+	}
 
-	for i, sub := range b.subscribers {
-		handler, ok := sub.handlers[event.Data().Topic]
-		if !ok {
-			continue
+	if !b.synchronous {
+		return nil
+	}
+
+	errs := make([]error, 0)
+	for _, d := range deliveries {
+		if err := b.handle(d); err != nil {
+			errs = append(errs, fmt.Errorf("handler of queue %q returned an error: %w", d.queue.identifier, err))
 		}
+	}
 
-		b.logger.Debug("sending event",
-			lf.String("topic", event.Data().Topic),
-			lf.Int("subscriber_index", i),
-		)
-
-		go func() {
-			err := handler(sub.ctx, event)
-			if err != nil {
-				b.logger.Error("failed to handle event",
-					lf.String("topic", event.Data().Topic),
-					lf.Err(err),
-				)
-			}
-		}()
+	return errors.Join(errs...)
+}
+
+// PublishBatch publishes the events one after the other, the error of each being reported in a xevents.BatchError.
+func (b *Broker) PublishBatch(ctx context.Context, events ...*xevents.Event) error {
+	failed := make(map[string]error)
+	for _, event := range events {
+		if err := b.Publish(ctx, event); err != nil {
+			failed[event.Data().ID] = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return &xevents.BatchError{Errors: failed}
 	}
+
 	return nil
 }
 
-func (b *Broker) Listen(ctx context.Context, identifier string, routingKeys []string, pairs ...xevents.HandlerPair) error {
+func (b *Broker) reportError(ctx context.Context, event *xevents.Event, err error) {
+	permanent := xerrs.IsPermanent(err)
+	b.logger.Error("failed to handle event",
+		lf.String("topic", event.Data().Topic),
+		lf.Bool("permanent", permanent),
+		lf.Err(err),
+	)
+
+	if b.errorHook != nil {
+		b.errorHook(ctx, event, err, permanent)
+	}
+}
+
+// Listen subscribes the handlers to the queue of the identifier.
+//
+// When the broker is closed or there is nothing to listen to, the returned subscription never receives any event.
+//
+// The concurrency option limits the number of handlers of the subscription run at the same time by the workers,
+// the partitions option makes the workers run the events of a partition one at a time, and the queue options
+// are applied as described on queue. Other options are ignored.
+func (b *Broker) Listen(ctx context.Context, identifier string, routingKeys []string, pairs []xevents.HandlerPair, opts ...xevents.ListenOption) (xevents.Subscription, error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	options := xevents.NewListenOptions(opts...)
+	c := &consumer{
+		broker:      b,
+		ctx:         ctx,
+		handlers:    make(map[string]xevents.Handler),
+		concurrency: options.Concurrency,
+		partitions:  options.Partitions,
+		busy:        make(map[int]bool),
+	}
+
 	if b.closed {
-		return nil
+		return c, nil
 	}
 
 	if len(pairs) == 0 {
-		return nil
+		return c, nil
 	}
 
 	if len(routingKeys) == 0 {
-		return nil
+		return c, nil
+	}
+
+	if err := b.topics.CheckPairs(pairs...); err != nil {
+		return nil, fmt.Errorf("cannot listen on unregistered topics: %w", err)
 	}
 
-	handlerMap := make(map[string]xevents.Handler)
-	for _, pair := range pairs {
-		handlerMap[pair.Topic] = pair.Handler
+	q, err := b.queue(identifier, options.Queue)
+	if err != nil {
+		return nil, err
 	}
 
-	sub := subscriber{
-		ctx:      ctx,
-		handlers: handlerMap,
+	for _, pair := range xevents.WrapPairs(pairs, b.middlewares...) {
+		c.handlers[pair.Topic] = pair.Handler
 	}
 
-	b.subscribers = append(b.subscribers, sub)
+	c.queue = q
+	q.bind(routingKeys)
+	q.consumers = append(q.consumers, c)
+
 	b.logger.Debug("subscribed to topics",
 		lf.String("identifier", identifier),
 		lf.Strings("routingKeys", routingKeys),
 	)
 
-	return nil
+	return c, nil
+}
+
+// queue returns the queue of the identifier, creating it if needed.
+// An empty identifier gets a new queue every time, like a server-named queue.
+//
+// Like RabbitMQ, it fails if the queue exists with other options.
+func (b *Broker) queue(identifier string, options xevents.QueueOptions) (*queue, error) {
+	if identifier != "" {
+		for _, q := range b.queues {
+			if q.identifier != identifier {
+				continue
+			}
+
+			if q.options != options {
+				return nil, fmt.Errorf("queue %q already exists with different options", identifier)
+			}
+
+			return q, nil
+		}
+	}
+
+	q := &queue{identifier: identifier, options: options}
+	b.queues = append(b.queues, q)
+	return q, nil
+}
+
+// prune forgets the consumers that stopped listening, and deletes the queue if it is auto-deleted and has none left.
+func (b *Broker) prune(q *queue) {
+	q.consumers = slices.DeleteFunc(q.consumers, func(c *consumer) bool {
+		return c.stopped || c.ctx.Err() != nil
+	})
+
+	if len(q.consumers) == 0 && q.options.AutoDelete {
+		b.queues = slices.DeleteFunc(b.queues, func(other *queue) bool {
+			return other == q
+		})
+	}
 }
 
+// Close stops accepting events and waits for the handlers of the events already published to return.
+//
+// Events published by these handlers are dropped. Calling Close from a handler never returns.
 func (b *Broker) Close() error {
 	b.mu.Lock()
-	defer b.mu.Unlock()
-
 	if b.closed {
+		b.mu.Unlock()
 		return nil
 	}
 
 	b.closed = true
 	close(b.quit)
+	// wake up the idle workers so that they can stop
+	b.available.Broadcast()
+	b.mu.Unlock()
 
-	return nil
+	return b.WaitIdle(context.Background())
 }
 
 func (b *Broker) Done() <-chan struct{} {
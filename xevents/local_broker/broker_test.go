@@ -0,0 +1,497 @@
+package local_broker_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xevents/local_broker"
+	"github.com/raphoester/x/xid"
+	"github.com/raphoester/x/xlog"
+	"github.com/raphoester/x/xtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func publish(t *testing.T, broker *local_broker.Broker, count int) {
+	for range count {
+		event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: "value"})
+		require.NoError(t, err)
+		require.NoError(t, broker.Publish(context.Background(), event))
+	}
+}
+
+func listen(t *testing.T, broker *local_broker.Broker, ctx context.Context, identifier string, routingKeys []string, pair xevents.HandlerPair, opts ...xevents.ListenOption) xevents.Subscription {
+	subscription, err := broker.Listen(ctx, identifier, routingKeys, []xevents.HandlerPair{pair}, opts...)
+	require.NoError(t, err)
+	return subscription
+}
+
+// storeMax keeps the highest value stored in max.
+func storeMax(max *atomic.Int32, value int32) {
+	for {
+		previous := max.Load()
+		if value <= previous || max.CompareAndSwap(previous, value) {
+			return
+		}
+	}
+}
+
+// recorder returns a handler pair counting the events handled by each consumer.
+func recorder(name string, handled map[string]int) xevents.HandlerPair {
+	return xevents.HandlerPair{
+		Topic: xevents.ExamplePayloadDefaultTopicName,
+		Handler: func(ctx context.Context, event *xevents.Event) error {
+			handled[name]++
+			return nil
+		},
+	}
+}
+
+func TestCompetingConsumers(t *testing.T) {
+	broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithSynchronous())
+	defer broker.Close()
+
+	handled := make(map[string]int)
+	routingKeys := []string{xevents.ExamplePayloadDefaultTopicName}
+
+	listen(t, broker, context.Background(), "group_a", routingKeys, recorder("a1", handled))
+	listen(t, broker, context.Background(), "group_a", routingKeys, recorder("a2", handled))
+	listen(t, broker, context.Background(), "group_b", routingKeys, recorder("b", handled))
+
+	publish(t, broker, 4)
+
+	assert.Equal(t, map[string]int{"a1": 2, "a2": 2, "b": 4}, handled)
+}
+
+func TestStoppedConsumerLeavesGroup(t *testing.T) {
+	broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithSynchronous())
+	defer broker.Close()
+
+	handled := make(map[string]int)
+	routingKeys := []string{xevents.ExamplePayloadDefaultTopicName}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	listen(t, broker, ctx, "group", routingKeys, recorder("stopped", handled))
+	listen(t, broker, context.Background(), "group", routingKeys, recorder("running", handled))
+	cancel()
+
+	publish(t, broker, 2)
+
+	assert.Equal(t, map[string]int{"running": 2}, handled)
+}
+
+func TestAnonymousQueues(t *testing.T) {
+	broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithSynchronous())
+	defer broker.Close()
+
+	handled := make(map[string]int)
+	routingKeys := []string{"#"}
+
+	listen(t, broker, context.Background(), "", routingKeys, recorder("first", handled))
+	listen(t, broker, context.Background(), "", routingKeys, recorder("second", handled))
+
+	publish(t, broker, 1)
+
+	assert.Equal(t, map[string]int{"first": 1, "second": 1}, handled)
+}
+
+func TestBindingsAreShared(t *testing.T) {
+	broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithSynchronous())
+	defer broker.Close()
+
+	handled := make(map[string]int)
+
+	// the second listener binds the queue to the topic, which makes the first one receive events too
+	listen(t, broker, context.Background(), "group", []string{"other.topic"}, recorder("first", handled))
+	listen(t, broker, context.Background(), "group", []string{xevents.ExamplePayloadDefaultTopicName}, recorder("second", handled))
+
+	publish(t, broker, 2)
+
+	assert.Equal(t, map[string]int{"first": 1, "second": 1}, handled)
+}
+
+func TestSynchronousErrors(t *testing.T) {
+	broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithSynchronous())
+	defer broker.Close()
+
+	failure := errors.New("failure")
+	pair := xevents.HandlerPair{
+		Topic: xevents.ExamplePayloadDefaultTopicName,
+		Handler: func(ctx context.Context, event *xevents.Event) error {
+			return failure
+		},
+	}
+
+	listen(t, broker, context.Background(), "first", []string{"#"}, pair)
+	listen(t, broker, context.Background(), "second", []string{"#"}, pair)
+
+	event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: "value"})
+	require.NoError(t, err)
+
+	err = broker.Publish(context.Background(), event)
+	assert.ErrorIs(t, err, failure)
+	assert.ErrorContains(t, err, `"first"`)
+	assert.ErrorContains(t, err, `"second"`)
+}
+
+func TestHandlersGetEventMetadata(t *testing.T) {
+	broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithSynchronous())
+	defer broker.Close()
+
+	var metadata xevents.Metadata
+	listen(t, broker, context.Background(), "metadata", []string{xevents.ExamplePayloadDefaultTopicName}, xevents.HandlerPair{
+		Topic: xevents.ExamplePayloadDefaultTopicName,
+		Handler: func(ctx context.Context, event *xevents.Event) error {
+			metadata = xevents.MetadataFromContext(ctx)
+			return nil
+		},
+	})
+
+	ctx := xevents.WithTenant(xevents.WithCorrelationID(context.Background(), "correlation"), "tenant")
+	event, err := xevents.New(ctx, xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{})
+	require.NoError(t, err)
+	require.NoError(t, broker.Publish(context.Background(), event))
+
+	assert.Equal(t, "correlation", metadata.CorrelationID())
+	assert.Equal(t, "tenant", metadata.Tenant())
+	assert.Equal(t, event.Data().ID, metadata.CausationID())
+}
+
+func TestWaitIdle(t *testing.T) {
+	broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithWorkers(2))
+	defer broker.Close()
+
+	var running, maxRunning, handled atomic.Int32
+	listen(t, broker, context.Background(), "group", []string{"#"}, xevents.HandlerPair{
+		Topic: xevents.ExamplePayloadDefaultTopicName,
+		Handler: func(ctx context.Context, event *xevents.Event) error {
+			storeMax(&maxRunning, running.Add(1))
+			defer running.Add(-1)
+			time.Sleep(10 * time.Millisecond)
+			handled.Add(1)
+			return nil
+		},
+	})
+
+	publish(t, broker, 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, broker.WaitIdle(ctx))
+
+	assert.EqualValues(t, 10, handled.Load())
+	assert.LessOrEqual(t, maxRunning.Load(), int32(2))
+}
+
+func TestCloseDrainsHandlers(t *testing.T) {
+	broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithWorkers(1))
+
+	var handled atomic.Int32
+	listen(t, broker, context.Background(), "group", []string{"#"}, xevents.HandlerPair{
+		Topic: xevents.ExamplePayloadDefaultTopicName,
+		Handler: func(ctx context.Context, event *xevents.Event) error {
+			time.Sleep(10 * time.Millisecond)
+			handled.Add(1)
+			return nil
+		},
+	})
+
+	publish(t, broker, 3)
+	require.NoError(t, broker.Close())
+	assert.EqualValues(t, 3, handled.Load())
+
+	// events published after closing are dropped
+	publish(t, broker, 1)
+	assert.EqualValues(t, 3, handled.Load())
+}
+
+func TestStopSubscription(t *testing.T) {
+	broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithWorkers(1))
+	defer broker.Close()
+
+	release := make(chan struct{})
+	var handled atomic.Int32
+	subscription := listen(t, broker, context.Background(), "group", []string{"#"}, xevents.HandlerPair{
+		Topic: xevents.ExamplePayloadDefaultTopicName,
+		Handler: func(ctx context.Context, event *xevents.Event) error {
+			<-release
+			handled.Add(1)
+			return nil
+		},
+	})
+
+	publish(t, broker, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, subscription.Stop(ctx), context.DeadlineExceeded, "handlers are still running")
+
+	close(release)
+	require.NoError(t, subscription.Stop(context.Background()))
+	assert.EqualValues(t, 2, handled.Load())
+
+	// the stopped subscription does not receive events anymore
+	publish(t, broker, 1)
+	require.NoError(t, broker.WaitIdle(context.Background()))
+	assert.EqualValues(t, 2, handled.Load())
+}
+
+func TestListenOptions(t *testing.T) {
+	t.Run("concurrency", func(t *testing.T) {
+		broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithWorkers(4))
+		defer broker.Close()
+
+		var running, maxRunning atomic.Int32
+		listen(t, broker, context.Background(), "group", []string{"#"}, xevents.HandlerPair{
+			Topic: xevents.ExamplePayloadDefaultTopicName,
+			Handler: func(ctx context.Context, event *xevents.Event) error {
+				storeMax(&maxRunning, running.Add(1))
+				defer running.Add(-1)
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			},
+		}, xevents.WithConcurrency(1))
+
+		publish(t, broker, 5)
+		require.NoError(t, broker.WaitIdle(context.Background()))
+		assert.EqualValues(t, 1, maxRunning.Load())
+	})
+
+	t.Run("queue options mismatch", func(t *testing.T) {
+		broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithSynchronous())
+		defer broker.Close()
+
+		handled := make(map[string]int)
+		listen(t, broker, context.Background(), "group", []string{"#"}, recorder("first", handled), xevents.WithDurableQueue())
+		listen(t, broker, context.Background(), "group", []string{"#"}, recorder("second", handled), xevents.WithDurableQueue(), xevents.WithPrefetch(10))
+
+		_, err := broker.Listen(context.Background(), "group", []string{"#"}, []xevents.HandlerPair{recorder("third", handled)})
+		assert.Error(t, err)
+	})
+
+	t.Run("auto delete", func(t *testing.T) {
+		broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithSynchronous())
+		defer broker.Close()
+
+		handled := make(map[string]int)
+		subscription := listen(t, broker, context.Background(), "group", []string{"#"}, recorder("first", handled), xevents.WithAutoDeleteQueue())
+		require.NoError(t, subscription.Stop(context.Background()))
+
+		// the queue is gone along with its options and bindings
+		listen(t, broker, context.Background(), "group", []string{"other.topic"}, recorder("second", handled))
+		publish(t, broker, 1)
+		assert.Empty(t, handled)
+	})
+
+	t.Run("max length", func(t *testing.T) {
+		broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithWorkers(1))
+		defer broker.Close()
+
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		var handled atomic.Int32
+		listen(t, broker, context.Background(), "group", []string{"#"}, xevents.HandlerPair{
+			Topic: xevents.ExamplePayloadDefaultTopicName,
+			Handler: func(ctx context.Context, event *xevents.Event) error {
+				select {
+				case started <- struct{}{}:
+				default:
+				}
+				<-release
+				handled.Add(1)
+				return nil
+			},
+		}, xevents.WithMaxLength(2), xevents.WithConcurrency(1))
+
+		publish(t, broker, 1)
+		// wait for the first event to be taken by the worker, so that only the next ones are waiting
+		<-started
+		publish(t, broker, 4)
+
+		close(release)
+		require.NoError(t, broker.WaitIdle(context.Background()))
+		assert.EqualValues(t, 3, handled.Load(), "the running event and the last two waiting ones")
+	})
+
+	t.Run("message ttl", func(t *testing.T) {
+		var elapsed atomic.Int64
+		start := time.Date(2024, time.October, 10, 0, 0, 0, 0, time.UTC)
+		clock := &xtime.CustomProvider{NowFunc: func() time.Time { return start.Add(time.Duration(elapsed.Load())) }}
+
+		broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithWorkers(1), local_broker.WithTimeProvider(clock))
+		defer broker.Close()
+
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		var handled atomic.Int32
+		listen(t, broker, context.Background(), "group", []string{"#"}, xevents.HandlerPair{
+			Topic: xevents.ExamplePayloadDefaultTopicName,
+			Handler: func(ctx context.Context, event *xevents.Event) error {
+				select {
+				case started <- struct{}{}:
+				default:
+				}
+				<-release
+				handled.Add(1)
+				return nil
+			},
+		}, xevents.WithMessageTTL(time.Minute), xevents.WithConcurrency(1))
+
+		publish(t, broker, 1)
+		<-started
+		publish(t, broker, 2)
+
+		// the waiting events expire by the clock of the broker
+		elapsed.Store(int64(2 * time.Minute))
+		close(release)
+		require.NoError(t, broker.WaitIdle(context.Background()))
+		assert.EqualValues(t, 1, handled.Load())
+	})
+}
+
+func TestPartitionedOrdering(t *testing.T) {
+	broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithWorkers(8))
+	defer broker.Close()
+
+	var mu sync.Mutex
+	handled := make(map[string][]string)
+	listen(t, broker, context.Background(), "group", []string{"#"}, xevents.HandlerPair{
+		Topic: xevents.ExamplePayloadDefaultTopicName,
+		Handler: xevents.UnmarshalHelper(func(ctx context.Context, event *xevents.Event, payload xevents.ExamplePayload) error {
+			// give the later events of the aggregate a chance to overtake this one
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			key := event.Data().Metadata.OrderingKey()
+			handled[key] = append(handled[key], payload.Key)
+			return nil
+		}),
+	}, xevents.WithPartitions(4))
+
+	expected := make(map[string][]string)
+	for i := range 20 {
+		for _, aggregate := range []string{"a", "b", "c"} {
+			key := fmt.Sprintf("%s%d", aggregate, i)
+			expected[aggregate] = append(expected[aggregate], key)
+
+			event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: key}.WithOrderingKey(aggregate))
+			require.NoError(t, err)
+			require.NoError(t, broker.Publish(context.Background(), event))
+		}
+	}
+
+	require.NoError(t, broker.WaitIdle(context.Background()))
+	assert.Equal(t, expected, handled)
+}
+
+func TestPublishBatch(t *testing.T) {
+	broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithSynchronous())
+	defer broker.Close()
+
+	failure := errors.New("failure")
+	listen(t, broker, context.Background(), "group", []string{"#"}, xevents.HandlerPair{
+		Topic: xevents.ExamplePayloadDefaultTopicName,
+		Handler: xevents.UnmarshalHelper(func(ctx context.Context, event *xevents.Event, payload xevents.ExamplePayload) error {
+			if payload.Key == "fail" {
+				return failure
+			}
+			return nil
+		}),
+	})
+
+	events := make([]*xevents.Event, 0)
+	for _, key := range []string{"ok", "fail"} {
+		event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: key})
+		require.NoError(t, err)
+		events = append(events, event)
+	}
+
+	err := broker.PublishBatch(context.Background(), events...)
+	var batchErr *xevents.BatchError
+	require.ErrorAs(t, err, &batchErr)
+	assert.Len(t, batchErr.Errors, 1)
+	assert.ErrorIs(t, batchErr.Errors[events[1].Data().ID], failure)
+}
+
+func TestScheduledEvents(t *testing.T) {
+	now := time.Date(2024, time.October, 10, 0, 0, 0, 0, time.UTC)
+	clock := &xtime.CustomProvider{NowFunc: func() time.Time { return now }}
+
+	// the ticker doesn't fire during the test, time only moves when the test says so
+	broker := local_broker.New(xlog.NewTestLogger(t),
+		local_broker.WithSynchronous(),
+		local_broker.WithTimeProvider(clock),
+		local_broker.WithTick(time.Minute),
+	)
+	defer broker.Close()
+
+	handled := make([]string, 0)
+	listen(t, broker, context.Background(), "reminders", []string{xevents.ExamplePayloadDefaultTopicName}, xevents.HandlerPair{
+		Topic: xevents.ExamplePayloadDefaultTopicName,
+		Handler: xevents.UnmarshalHelper(func(ctx context.Context, event *xevents.Event, payload xevents.ExamplePayload) error {
+			handled = append(handled, payload.Key)
+			return nil
+		}),
+	})
+
+	newEvent := func(key string) *xevents.Event {
+		event, err := xevents.New(context.Background(), clock, xid.RandomGenerator{}, xevents.ExamplePayload{Key: key})
+		require.NoError(t, err)
+		return event
+	}
+
+	ctx := context.Background()
+	require.NoError(t, broker.PublishAfter(ctx, newEvent("in 30 minutes"), 30*time.Minute))
+	require.NoError(t, broker.PublishAt(ctx, newEvent("in 2 days"), now.Add(48*time.Hour)))
+	require.NoError(t, broker.Publish(ctx, newEvent("delayed 10 minutes").DelayedUntil(now.Add(10*time.Minute))))
+	require.NoError(t, broker.PublishAt(ctx, newEvent("past"), now.Add(-time.Minute)))
+	assert.Equal(t, []string{"past"}, handled, "events whose time has come are published right away")
+
+	now = now.Add(29 * time.Minute)
+	broker.Tick()
+	assert.Equal(t, []string{"past", "delayed 10 minutes"}, handled)
+
+	now = now.Add(time.Minute)
+	broker.Tick()
+	assert.Equal(t, []string{"past", "delayed 10 minutes", "in 30 minutes"}, handled)
+
+	now = now.Add(72 * time.Hour)
+	broker.Tick()
+	assert.Equal(t, []string{"past", "delayed 10 minutes", "in 30 minutes", "in 2 days"}, handled)
+
+	require.NoError(t, broker.Close())
+	assert.ErrorIs(t, broker.PublishAfter(ctx, newEvent("after close"), time.Minute), local_broker.ErrClosed)
+}
+
+func TestScheduledEventsWithRealTime(t *testing.T) {
+	broker := local_broker.New(xlog.NewTestLogger(t), local_broker.WithTick(5*time.Millisecond))
+	defer broker.Close()
+
+	handled := make(chan struct{}, 1)
+	listen(t, broker, context.Background(), "reminders", []string{xevents.ExamplePayloadDefaultTopicName}, xevents.HandlerPair{
+		Topic: xevents.ExamplePayloadDefaultTopicName,
+		Handler: func(ctx context.Context, event *xevents.Event) error {
+			handled <- struct{}{}
+			return nil
+		},
+	})
+
+	event, err := xevents.New(context.Background(), xtime.RealProvider{}, xid.RandomGenerator{}, xevents.ExamplePayload{})
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, broker.PublishAfter(context.Background(), event, 30*time.Millisecond))
+
+	select {
+	case <-handled:
+		assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+	case <-time.After(time.Second):
+		t.Fatal("scheduled event not handled")
+	}
+}
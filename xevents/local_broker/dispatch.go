@@ -0,0 +1,273 @@
+package local_broker
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"time"
+
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xlog/lf"
+)
+
+type delivery struct {
+	consumer   *consumer
+	queue      *queue
+	event      *xevents.Event
+	handler    xevents.Handler
+	partition  int
+	enqueuedAt time.Time
+}
+
+// partitionOf returns the partition of the consumer the event belongs to, or -1 if the consumer is not partitioned.
+func partitionOf(c *consumer, event *xevents.Event) int {
+	if c.partitions <= 1 {
+		return -1
+	}
+
+	key := event.Data().Metadata.OrderingKey()
+	if key == "" {
+		key = event.Data().ID
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(c.partitions))
+}
+
+// route decodes the event and picks the handlers it must be delivered to.
+//
+// The deliveries are counted as in flight until handled. In asynchronous mode they are queued for the workers.
+func (b *Broker) route(event *xevents.Event) ([]delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, nil
+	}
+
+	b.logger.Debug("publishing event",
+		lf.String("topic", event.Data().Topic),
+	)
+
+	event, err := b.topics.Decode(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode event: %w", err)
+	}
+
+	deliveries := make([]delivery, 0)
+	// pruning may delete queues, iterate over a copy
+	for _, q := range slices.Clone(b.queues) {
+		// filter the deliveries the way a topic exchange would, based on the keys the queue is bound with
+		if !matchesAny(q.routingKeys, event.Data().Topic) {
+			continue
+		}
+
+		b.prune(q)
+		c := q.nextConsumer()
+		if c == nil {
+			continue
+		}
+
+		// like with RabbitMQ, the consumer the event is given to drops it if it has no handler for the topic,
+		// even if another consumer of the queue has one
+		handler, ok := c.handlers[event.Data().Topic]
+		if !ok {
+			b.logger.Info("received unprocessable topic, dropping",
+				lf.String("topic", event.Data().Topic),
+				lf.String("identifier", q.identifier),
+			)
+			continue
+		}
+
+		b.logger.Debug("sending event",
+			lf.String("topic", event.Data().Topic),
+			lf.String("identifier", q.identifier),
+		)
+
+		c.running.Add(1)
+		deliveries = append(deliveries, delivery{
+			consumer:   c,
+			queue:      q,
+			event:      event,
+			handler:    handler,
+			partition:  partitionOf(c, event),
+			enqueuedAt: b.clock.Now(),
+		})
+	}
+
+	if len(deliveries) == 0 {
+		return deliveries, nil
+	}
+
+	if b.inFlight == 0 {
+		b.idle = make(chan struct{})
+	}
+	b.inFlight += len(deliveries)
+
+	if b.synchronous {
+		// handled right away by the caller
+		for _, d := range deliveries {
+			d.consumer.active++
+		}
+		return deliveries, nil
+	}
+
+	b.startWorkers()
+	for _, d := range deliveries {
+		b.backlog = append(b.backlog, d)
+		d.queue.waiting++
+
+		if d.queue.options.MaxLength > 0 && d.queue.waiting > d.queue.options.MaxLength {
+			b.dropOldest(d.queue)
+		}
+	}
+	b.available.Broadcast()
+
+	return deliveries, nil
+}
+
+// handle runs the handler of the delivery and reports its error, if any.
+func (b *Broker) handle(d delivery) error {
+	defer b.done(d)
+
+	ctx := xevents.ContextFromEvent(d.consumer.ctx, d.event)
+	err := d.handler(ctx, d.event)
+	if err != nil {
+		b.reportError(ctx, d.event, err)
+	}
+
+	return err
+}
+
+func (b *Broker) done(d delivery) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d.consumer.active--
+	if d.partition >= 0 {
+		delete(d.consumer.busy, d.partition)
+	}
+	b.release(d)
+
+	// the consumer may have been at its concurrency limit
+	b.available.Broadcast()
+}
+
+// release stops counting the delivery as in flight. The lock must be held.
+func (b *Broker) release(d delivery) {
+	d.consumer.running.Done()
+
+	b.inFlight--
+	if b.inFlight == 0 {
+		close(b.idle)
+	}
+}
+
+// take removes from the backlog the first delivery whose consumer can run one more handler,
+// discarding the expired deliveries on the way. The lock must be held.
+func (b *Broker) take() (delivery, bool) {
+	now := b.clock.Now()
+	for i := 0; i < len(b.backlog); i++ {
+		d := b.backlog[i]
+
+		if ttl := d.queue.options.MessageTTL; ttl > 0 && now.Sub(d.enqueuedAt) > ttl {
+			b.logger.Info("event expired in queue, dropping",
+				lf.String("topic", d.event.Data().Topic),
+				lf.String("identifier", d.queue.identifier),
+			)
+			b.remove(i)
+			b.release(d)
+			i--
+			continue
+		}
+
+		if d.consumer.concurrency > 0 && d.consumer.active >= d.consumer.concurrency {
+			continue
+		}
+
+		// the deliveries of a partition are run one at a time, the oldest first since the backlog is ordered
+		if d.partition >= 0 && d.consumer.busy[d.partition] {
+			continue
+		}
+
+		b.remove(i)
+		d.consumer.active++
+		if d.partition >= 0 {
+			d.consumer.busy[d.partition] = true
+		}
+		return d, true
+	}
+
+	return delivery{}, false
+}
+
+// dropOldest discards the oldest delivery waiting in the queue, like an overflowing RabbitMQ queue. The lock must be held.
+func (b *Broker) dropOldest(q *queue) {
+	i := slices.IndexFunc(b.backlog, func(d delivery) bool {
+		return d.queue == q
+	})
+	if i < 0 {
+		return
+	}
+
+	d := b.backlog[i]
+	b.logger.Info("queue is full, dropping oldest event",
+		lf.String("topic", d.event.Data().Topic),
+		lf.String("identifier", q.identifier),
+	)
+	b.remove(i)
+	b.release(d)
+}
+
+func (b *Broker) remove(i int) {
+	b.backlog[i].queue.waiting--
+	b.backlog = slices.Delete(b.backlog, i, i+1)
+}
+
+// startWorkers starts the workers on the first delivery, so that brokers never publishing don't run any.
+// It must be called with the mutex held.
+func (b *Broker) startWorkers() {
+	if b.working {
+		return
+	}
+	b.working = true
+
+	for range b.workers {
+		go b.work()
+	}
+}
+
+// work runs the queued deliveries until the broker is closed and there is nothing left to run.
+func (b *Broker) work() {
+	for {
+		b.mu.Lock()
+		d, ok := b.take()
+		for !ok && (!b.closed || len(b.backlog) > 0) {
+			b.available.Wait()
+			d, ok = b.take()
+		}
+		b.mu.Unlock()
+
+		if !ok {
+			return
+		}
+
+		_ = b.handle(d)
+	}
+}
+
+// WaitIdle blocks until every published event has been handled, including the events published by the handlers.
+func (b *Broker) WaitIdle(ctx context.Context) error {
+	b.mu.Lock()
+	idle := b.idle
+	b.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,53 @@
+package local_broker
+
+import "strings"
+
+// matchesAny tells whether the routing key matches any of the binding keys.
+func matchesAny(bindingKeys []string, routingKey string) bool {
+	for _, bindingKey := range bindingKeys {
+		if matchRoutingKey(bindingKey, routingKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRoutingKey implements the matching of a topic exchange: the keys are lists of words separated by dots,
+// and in the binding key "*" substitutes exactly one word while "#" substitutes zero or more words.
+func matchRoutingKey(bindingKey, routingKey string) bool {
+	return matchWords(strings.Split(bindingKey, "."), strings.Split(routingKey, "."))
+}
+
+func matchWords(pattern, words []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			// collapse consecutive hashes, they match the same thing as a single one
+			for len(pattern) > 1 && pattern[1] == "#" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(words); i++ {
+				if matchWords(pattern[1:], words[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(words) == 0 {
+				return false
+			}
+		default:
+			if len(words) == 0 || pattern[0] != words[0] {
+				return false
+			}
+		}
+
+		pattern = pattern[1:]
+		words = words[1:]
+	}
+
+	return len(words) == 0
+}
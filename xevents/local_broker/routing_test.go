@@ -0,0 +1,45 @@
+package local_broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchRoutingKey(t *testing.T) {
+	tests := []struct {
+		bindingKey string
+		routingKey string
+		match      bool
+	}{
+		{bindingKey: "user.created", routingKey: "user.created", match: true},
+		{bindingKey: "user.created", routingKey: "user.deleted", match: false},
+		{bindingKey: "user.created", routingKey: "user.created.v2", match: false},
+		{bindingKey: "user.*", routingKey: "user.created", match: true},
+		{bindingKey: "user.*", routingKey: "user", match: false},
+		{bindingKey: "user.*", routingKey: "user.created.v2", match: false},
+		{bindingKey: "*.created", routingKey: "user.created", match: true},
+		{bindingKey: "*", routingKey: "user", match: true},
+		{bindingKey: "*", routingKey: "", match: true},
+		{bindingKey: "#", routingKey: "user.created.v2", match: true},
+		{bindingKey: "#", routingKey: "", match: true},
+		{bindingKey: "user.#", routingKey: "user", match: true},
+		{bindingKey: "user.#", routingKey: "user.created.v2", match: true},
+		{bindingKey: "user.#", routingKey: "users.created", match: false},
+		{bindingKey: "#.created", routingKey: "created", match: true},
+		{bindingKey: "#.created", routingKey: "user.account.created", match: true},
+		{bindingKey: "#.created", routingKey: "user.created.v2", match: false},
+		{bindingKey: "user.#.v2", routingKey: "user.v2", match: true},
+		{bindingKey: "user.#.v2", routingKey: "user.created.v2", match: true},
+		{bindingKey: "user.#.#.v2", routingKey: "user.a.b.v2", match: true},
+		{bindingKey: "*.#", routingKey: "user", match: true},
+		{bindingKey: "*.*.#", routingKey: "user", match: false},
+		{bindingKey: "#.*", routingKey: "user.created", match: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.bindingKey+" "+tt.routingKey, func(t *testing.T) {
+			assert.Equal(t, tt.match, matchRoutingKey(tt.bindingKey, tt.routingKey))
+		})
+	}
+}
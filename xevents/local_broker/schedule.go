@@ -0,0 +1,145 @@
+package local_broker
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xlog/lf"
+)
+
+const wheelSlots = 512
+
+type scheduled struct {
+	at    time.Time
+	event *xevents.Event
+}
+
+// timerWheel holds the scheduled events in slots of one tick each, the slot of an event being where the wheel
+// points to once its time has come. Events further than a turn of the wheel wait for the following turns.
+type timerWheel struct {
+	tick    time.Duration
+	slots   [wheelSlots][]scheduled
+	current int
+	// last is the time the wheel points to, the events scheduled up to then have been taken out
+	last time.Time
+	size int
+}
+
+func newTimerWheel(tick time.Duration, now time.Time) *timerWheel {
+	return &timerWheel{tick: tick, last: now}
+}
+
+// add schedules the event, it returns false if its time has already come.
+func (w *timerWheel) add(at time.Time, event *xevents.Event) bool {
+	if !at.After(w.last) {
+		return false
+	}
+
+	ticks := int((at.Sub(w.last) + w.tick - 1) / w.tick)
+	slot := (w.current + ticks) % wheelSlots
+	w.slots[slot] = append(w.slots[slot], scheduled{at: at, event: event})
+	w.size++
+	return true
+}
+
+// advance moves the wheel up to now, and returns the events whose time has come, in order.
+func (w *timerWheel) advance(now time.Time) []scheduled {
+	steps := int(now.Sub(w.last) / w.tick)
+	if steps <= 0 {
+		return nil
+	}
+
+	due := make([]scheduled, 0)
+	// past a whole turn every slot is visited, once is enough
+	for i := range min(steps, wheelSlots) {
+		slot := (w.current + 1 + i) % wheelSlots
+		w.slots[slot] = slices.DeleteFunc(w.slots[slot], func(s scheduled) bool {
+			if s.at.After(now) {
+				return false
+			}
+			due = append(due, s)
+			return true
+		})
+	}
+
+	w.current = (w.current + steps) % wheelSlots
+	w.last = w.last.Add(time.Duration(steps) * w.tick)
+	w.size -= len(due)
+
+	slices.SortStableFunc(due, func(a, b scheduled) int {
+		return a.at.Compare(b.at)
+	})
+	return due
+}
+
+// PublishAt publishes the event once the time provider of the broker (see WithTimeProvider) reaches the given time.
+//
+// Scheduled events are kept in memory, and are dropped when the broker is closed. Scheduling an event on a closed
+// broker fails with ErrClosed.
+func (b *Broker) PublishAt(ctx context.Context, event *xevents.Event, at time.Time) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+
+	if b.wheel.add(at, event) {
+		b.startTicker()
+		b.mu.Unlock()
+		return nil
+	}
+	b.mu.Unlock()
+
+	return b.publish(ctx, event)
+}
+
+func (b *Broker) PublishAfter(ctx context.Context, event *xevents.Event, delay time.Duration) error {
+	return b.PublishAt(ctx, event, b.clock.Now().Add(delay))
+}
+
+// Tick publishes the scheduled events whose time has come. It is called every tick (see WithTick),
+// tests moving their time provider forward can call it to publish the events due right away.
+func (b *Broker) Tick() {
+	b.mu.Lock()
+	due := b.wheel.advance(b.clock.Now())
+	b.mu.Unlock()
+
+	for _, s := range due {
+		if err := b.publish(context.Background(), s.event); err != nil {
+			b.reportError(context.Background(), s.event, err)
+		}
+	}
+}
+
+// startTicker starts ticking once an event is scheduled, so that brokers never scheduling any don't run the ticker.
+// It must be called with the mutex held.
+func (b *Broker) startTicker() {
+	if b.ticking {
+		return
+	}
+	b.ticking = true
+
+	go b.runTicker()
+}
+
+func (b *Broker) runTicker() {
+	ticker := time.NewTicker(b.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.quit:
+			b.mu.Lock()
+			dropped := b.wheel.size
+			b.mu.Unlock()
+			if dropped > 0 {
+				b.logger.Warning("dropped scheduled events on close", lf.Int("count", dropped))
+			}
+			return
+		case <-ticker.C:
+			b.Tick()
+		}
+	}
+}
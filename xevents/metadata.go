@@ -0,0 +1,161 @@
+package xevents
+
+import "context"
+
+// Metadata is the envelope travelling alongside an event's payload.
+//
+// It is a flat string map so that it can be carried as-is by any transport (AMQP headers, document fields...).
+// The well-known keys below have first-class accessors, any other key is forwarded untouched.
+type Metadata map[string]string
+
+const (
+	MetadataCorrelationID = "correlation_id"
+	MetadataCausationID   = "causation_id"
+	MetadataTenant        = "tenant"
+	MetadataOrderingKey   = "ordering_key"
+
+	// W3C trace context, see https://www.w3.org/TR/trace-context/
+	MetadataTraceParent = "traceparent"
+	MetadataTraceState  = "tracestate"
+
+	// Message properties, carried by the transports supporting them (like the AMQP basic properties).
+	// Priority is a number, and expiration a number of milliseconds.
+	MetadataReplyTo     = "reply_to"
+	MetadataPriority    = "priority"
+	MetadataExpiration  = "expiration"
+	MetadataMessageType = "message_type"
+	MetadataAppID       = "app_id"
+	MetadataUserID      = "user_id"
+)
+
+// messageScopedMetadata are the keys describing a single message, which the events created while handling it
+// don't inherit (see ContextFromEvent).
+var messageScopedMetadata = []string{
+	MetadataReplyTo,
+	MetadataPriority,
+	MetadataExpiration,
+	MetadataMessageType,
+	MetadataAppID,
+	MetadataUserID,
+}
+
+func (m Metadata) Get(key string) string {
+	if m == nil {
+		return ""
+	}
+	return m[key]
+}
+
+func (m Metadata) CorrelationID() string { return m.Get(MetadataCorrelationID) }
+func (m Metadata) CausationID() string   { return m.Get(MetadataCausationID) }
+func (m Metadata) Tenant() string        { return m.Get(MetadataTenant) }
+func (m Metadata) OrderingKey() string   { return m.Get(MetadataOrderingKey) }
+func (m Metadata) TraceParent() string   { return m.Get(MetadataTraceParent) }
+func (m Metadata) TraceState() string    { return m.Get(MetadataTraceState) }
+func (m Metadata) ReplyTo() string       { return m.Get(MetadataReplyTo) }
+func (m Metadata) Priority() string      { return m.Get(MetadataPriority) }
+func (m Metadata) Expiration() string    { return m.Get(MetadataExpiration) }
+func (m Metadata) MessageType() string   { return m.Get(MetadataMessageType) }
+func (m Metadata) AppID() string         { return m.Get(MetadataAppID) }
+func (m Metadata) UserID() string        { return m.Get(MetadataUserID) }
+
+// Clone returns a copy of the metadata that can be modified without altering the original.
+func (m Metadata) Clone() Metadata {
+	cp := make(Metadata, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
+// merge returns a copy of m overridden by the non-empty values of other.
+func (m Metadata) merge(other Metadata) Metadata {
+	cp := m.Clone()
+	for k, v := range other {
+		if v == "" {
+			continue
+		}
+		cp[k] = v
+	}
+	return cp
+}
+
+type metadataCtxKey struct{}
+
+// ContextWithMetadata attaches metadata to the context, on top of the metadata it may already carry.
+//
+// Events created with New from this context inherit it.
+func ContextWithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataCtxKey{}, MetadataFromContext(ctx).merge(md))
+}
+
+// MetadataFromContext returns a copy of the metadata carried by the context.
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataCtxKey{}).(Metadata)
+	return md.Clone()
+}
+
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return ContextWithMetadata(ctx, Metadata{MetadataCorrelationID: id})
+}
+
+func WithCausationID(ctx context.Context, id string) context.Context {
+	return ContextWithMetadata(ctx, Metadata{MetadataCausationID: id})
+}
+
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return ContextWithMetadata(ctx, Metadata{MetadataTenant: tenant})
+}
+
+func WithTraceContext(ctx context.Context, traceParent, traceState string) context.Context {
+	return ContextWithMetadata(ctx, Metadata{
+		MetadataTraceParent: traceParent,
+		MetadataTraceState:  traceState,
+	})
+}
+
+// ContextFromEvent prepares the context under which a received event is handled.
+//
+// The event's metadata is propagated, and the event itself becomes the cause of any event
+// created while handling it, so that a chain of events can be followed across services.
+// The message properties (reply-to, priority...) only describe the received event and are not propagated.
+func ContextFromEvent(ctx context.Context, event *Event) context.Context {
+	md := event.Data().Metadata.Clone()
+	for _, key := range messageScopedMetadata {
+		delete(md, key)
+	}
+	if md.CorrelationID() == "" {
+		md[MetadataCorrelationID] = event.Data().ID
+	}
+	md[MetadataCausationID] = event.Data().ID
+	return ContextWithMetadata(ctx, md)
+}
+
+type deliveryAttemptCtxKey struct{}
+
+// ContextWithDeliveryAttempt is used by listeners to tell handlers how many times the event has been delivered.
+func ContextWithDeliveryAttempt(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, deliveryAttemptCtxKey{}, attempt)
+}
+
+// DeliveryAttempt returns the number of the current attempt at handling the event, starting at 1.
+func DeliveryAttempt(ctx context.Context) int {
+	attempt, ok := ctx.Value(deliveryAttemptCtxKey{}).(int)
+	if !ok || attempt < 1 {
+		return 1
+	}
+	return attempt
+}
+
+type replayOffsetCtxKey struct{}
+
+// ContextWithReplayOffset is used by listeners of replayable subscriptions to tell handlers the offset of the event.
+func ContextWithReplayOffset(ctx context.Context, offset int64) context.Context {
+	return context.WithValue(ctx, replayOffsetCtxKey{}, offset)
+}
+
+// ReplayOffsetOf returns the offset of the event in the log a replayable subscription reads, see ReplayFromOffset.
+func ReplayOffsetOf(ctx context.Context) (int64, bool) {
+	offset, ok := ctx.Value(replayOffsetCtxKey{}).(int64)
+	return offset, ok
+}
@@ -0,0 +1,75 @@
+package xevents_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xid"
+	"github.com/raphoester/x/xtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStartsCorrelationChain(t *testing.T) {
+	event, err := xevents.New(
+		context.Background(),
+		xtime.NewDefaultFixedProvider(),
+		xid.NewDefaultFixedGenerator(),
+		xevents.ExamplePayload{Key: "value"},
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, event.Data().ID, event.Data().Metadata.CorrelationID())
+	assert.Empty(t, event.Data().Metadata.CausationID())
+}
+
+func TestMetadataPropagatesThroughHandlerContext(t *testing.T) {
+	ctx := xevents.WithTenant(context.Background(), "tenant")
+	ctx = xevents.WithTraceContext(ctx, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "")
+
+	first, err := xevents.New(ctx, xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{})
+	require.NoError(t, err)
+
+	// simulate a broker delivering the first event to a handler that creates a second one
+	handlerCtx := xevents.ContextFromEvent(context.Background(), first)
+	second, err := xevents.New(handlerCtx, xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{})
+	require.NoError(t, err)
+
+	md := second.Data().Metadata
+	assert.Equal(t, first.Data().ID, md.CorrelationID())
+	assert.Equal(t, first.Data().ID, md.CausationID())
+	assert.Equal(t, "tenant", md.Tenant())
+	assert.Equal(t, first.Data().Metadata.TraceParent(), md.TraceParent())
+	assert.NotContains(t, md, xevents.MetadataTraceState)
+}
+
+func TestOrderingKeyIsNotInherited(t *testing.T) {
+	first, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{}.WithOrderingKey("aggregate"))
+	require.NoError(t, err)
+	assert.Equal(t, "aggregate", first.Data().Metadata.OrderingKey())
+
+	second, err := xevents.New(xevents.ContextFromEvent(context.Background(), first), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{})
+	require.NoError(t, err)
+	assert.NotContains(t, second.Data().Metadata, xevents.MetadataOrderingKey)
+}
+
+func TestMessagePropertiesAreNotInherited(t *testing.T) {
+	ctx := xevents.ContextWithMetadata(context.Background(), xevents.Metadata{
+		xevents.MetadataTenant:   "tenant",
+		xevents.MetadataPriority: "5",
+		xevents.MetadataAppID:    "billing",
+	})
+
+	first, err := xevents.New(ctx, xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{})
+	require.NoError(t, err)
+	assert.Equal(t, "5", first.Data().Metadata.Priority(), "properties set on the context apply")
+
+	second, err := xevents.New(xevents.ContextFromEvent(context.Background(), first), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{})
+	require.NoError(t, err)
+
+	md := second.Data().Metadata
+	assert.Equal(t, "tenant", md.Tenant())
+	assert.NotContains(t, md, xevents.MetadataPriority)
+	assert.NotContains(t, md, xevents.MetadataAppID)
+}
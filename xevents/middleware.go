@@ -0,0 +1,162 @@
+package xevents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/raphoester/x/xerrs"
+	"github.com/raphoester/x/xlog"
+	"github.com/raphoester/x/xlog/lf"
+)
+
+// Middleware decorates a handler with cross-cutting behavior (logging, recovery, metrics...).
+type Middleware func(Handler) Handler
+
+// Chain wraps the handler with the middlewares, the first one being the outermost.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// With returns a copy of the pair whose handler is wrapped with the middlewares.
+func (p HandlerPair) With(middlewares ...Middleware) HandlerPair {
+	return HandlerPair{
+		Topic:   p.Topic,
+		Handler: Chain(p.Handler, middlewares...),
+	}
+}
+
+// WrapPairs wraps the handler of every pair with the middlewares.
+func WrapPairs(pairs []HandlerPair, middlewares ...Middleware) []HandlerPair {
+	if len(middlewares) == 0 {
+		return pairs
+	}
+
+	wrapped := make([]HandlerPair, 0, len(pairs))
+	for _, pair := range pairs {
+		wrapped = append(wrapped, pair.With(middlewares...))
+	}
+	return wrapped
+}
+
+// Recovery turns the panics of the handler into errors.
+func Recovery(logger xlog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event *Event) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error("panic occurred while handling event",
+						lf.String("event_id", event.Data().ID),
+						lf.String("event_topic", event.Data().Topic),
+						lf.Any("panic", r),
+						lf.String("stack", string(debug.Stack())),
+					)
+					err = fmt.Errorf("handler panicked: %v", r)
+				}
+			}()
+
+			return next(ctx, event)
+		}
+	}
+}
+
+// Timeout bounds the duration of each handler call through its context.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event *Event) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			return next(ctx, event)
+		}
+	}
+}
+
+// Logging logs the outcome of each handler call along with the event's identity.
+func Logging(logger xlog.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event *Event) error {
+			fields := []lf.Field{
+				lf.String("event_id", event.Data().ID),
+				lf.String("event_topic", event.Data().Topic),
+				lf.String("correlation_id", event.Data().Metadata.CorrelationID()),
+			}
+
+			logger.Debug("handling event", fields...)
+
+			start := time.Now()
+			err := next(ctx, event)
+			fields = append(fields, lf.Duration("duration", time.Since(start)))
+
+			if err != nil {
+				logger.Warning("failed to handle event", append(fields, lf.Err(err))...)
+				return err
+			}
+
+			logger.Debug("handled event", fields...)
+			return nil
+		}
+	}
+}
+
+// MetricsRecorder receives the measurements of the Metrics middleware.
+type MetricsRecorder interface {
+	ObserveHandling(topic string, duration time.Duration, err error)
+}
+
+// MetricsRecorderFunc allows using a simple function as a MetricsRecorder.
+type MetricsRecorderFunc func(topic string, duration time.Duration, err error)
+
+func (f MetricsRecorderFunc) ObserveHandling(topic string, duration time.Duration, err error) {
+	f(topic, duration, err)
+}
+
+// Metrics reports the duration and outcome of each handler call.
+func Metrics(recorder MetricsRecorder) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event *Event) error {
+			start := time.Now()
+			err := next(ctx, event)
+			recorder.ObserveHandling(event.Data().Topic, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// ErrorClassifier rewrites a handler error, typically to tell listeners how to treat it.
+type ErrorClassifier func(event *Event, err error) error
+
+// ClassifyErrors passes the errors returned by the handler through the classifiers, in order.
+func ClassifyErrors(classifiers ...ErrorClassifier) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, event *Event) error {
+			err := next(ctx, event)
+			if err == nil {
+				return nil
+			}
+
+			for _, classify := range classifiers {
+				err = classify(event, err)
+			}
+
+			return err
+		}
+	}
+}
+
+// PermanentOn is a classifier marking as permanent the errors matching any of the targets.
+func PermanentOn(targets ...error) ErrorClassifier {
+	return func(_ *Event, err error) error {
+		for _, target := range targets {
+			if errors.Is(err, target) {
+				return xerrs.Permanent(err)
+			}
+		}
+		return err
+	}
+}
@@ -0,0 +1,91 @@
+package xevents_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xlog"
+	"github.com/raphoester/x/xtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEvent() *xevents.Event {
+	return xevents.Restore("id", xtime.NewDefaultFixedProvider().Now(), "topic", []byte(`{}`))
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	tracing := func(name string) xevents.Middleware {
+		return func(next xevents.Handler) xevents.Handler {
+			return func(ctx context.Context, event *xevents.Event) error {
+				calls = append(calls, name+" in")
+				err := next(ctx, event)
+				calls = append(calls, name+" out")
+				return err
+			}
+		}
+	}
+
+	pair := xevents.HandlerPair{
+		Topic: "topic",
+		Handler: func(ctx context.Context, event *xevents.Event) error {
+			calls = append(calls, "handler")
+			return nil
+		},
+	}
+
+	pairs := xevents.WrapPairs([]xevents.HandlerPair{pair.With(tracing("pair"))}, tracing("global"))
+	require.NoError(t, pairs[0].Handler(context.Background(), testEvent()))
+
+	assert.Equal(t, []string{"global in", "pair in", "handler", "pair out", "global out"}, calls)
+}
+
+func TestRecovery(t *testing.T) {
+	handler := xevents.Chain(func(ctx context.Context, event *xevents.Event) error {
+		panic("boom")
+	}, xevents.Recovery(xlog.NopLogger{}))
+
+	err := handler(context.Background(), testEvent())
+	assert.ErrorContains(t, err, "boom")
+}
+
+func TestTimeout(t *testing.T) {
+	handler := xevents.Chain(func(ctx context.Context, event *xevents.Event) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, xevents.Timeout(10*time.Millisecond))
+
+	err := handler(context.Background(), testEvent())
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestMetricsAndClassification(t *testing.T) {
+	errBusiness := errors.New("business error")
+
+	var observedTopic string
+	var observedErr error
+	recorder := xevents.MetricsRecorderFunc(func(topic string, _ time.Duration, err error) {
+		observedTopic = topic
+		observedErr = err
+	})
+
+	classifier := func(event *xevents.Event, err error) error {
+		return fmt.Errorf("classified on %s: %w", event.Data().Topic, err)
+	}
+
+	handler := xevents.Chain(func(ctx context.Context, event *xevents.Event) error {
+		return errBusiness
+	}, xevents.Metrics(recorder), xevents.ClassifyErrors(classifier))
+
+	err := handler(context.Background(), testEvent())
+	assert.ErrorIs(t, err, errBusiness)
+	assert.ErrorContains(t, err, "classified on topic")
+
+	assert.Equal(t, "topic", observedTopic)
+	assert.Equal(t, err, observedErr, "metrics see the classified error")
+}
@@ -0,0 +1,19 @@
+package xevents
+
+// Ordered payloads carry an ordering key, typically the ID of the aggregate they are about.
+//
+// Subscriptions listening with partitions (see WithPartitions) handle the events sharing an ordering key
+// one at a time and in publish order, while events with different keys are still handled in parallel.
+type Ordered interface {
+	OrderingKey() string
+}
+
+// orderingKeyOf returns the ordering key of the payload, if any.
+//
+// It only comes from the payload: unlike the rest of the metadata, it is not inherited from the context.
+func orderingKeyOf(p Payload) string {
+	if ordered, ok := p.(Ordered); ok {
+		return ordered.OrderingKey()
+	}
+	return ""
+}
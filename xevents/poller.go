@@ -56,25 +56,48 @@ type OutboxStorage interface {
 	Save(ctx context.Context, events ...*Event) error
 }
 
+// BatchOutboxStorage is implemented by the outbox storages able to mark several events as published at once.
+type BatchOutboxStorage interface {
+	MarkAllAsPublished(ctx context.Context, ids ...string) error
+}
+
+// poll publishes the pending events as a single batch when the publisher supports it (see BatchPublisher).
 func (p *Poller) poll(ctx context.Context) error {
 	events, err := p.storage.GetPending(context.Background())
 	if err != nil {
 		return fmt.Errorf("failed to get pending events: %w", err)
 	}
 
+	if len(events) == 0 {
+		return nil
+	}
+
 	ctx = context.Background()
 	for _, event := range events {
 		p.logger.Debug("publishing event",
 			lf.String("event_id", event.Data().ID),
 			lf.String("event_topic", event.Data().Topic),
 		)
+	}
 
-		if err := p.publisher.Publish(ctx, event); err != nil {
-			p.logger.Warning("failed to publish event", lf.Err(err))
-			continue
+	published, err := PublishAll(ctx, p.publisher, events...)
+	if err != nil {
+		p.logger.Warning("failed to publish events", lf.Err(err))
+	}
+
+	if len(published) == 0 {
+		return nil
+	}
+
+	if storage, ok := p.storage.(BatchOutboxStorage); ok {
+		if err := storage.MarkAllAsPublished(ctx, published...); err != nil {
+			p.logger.Error("failed to mark events as published", lf.Err(err))
 		}
+		return nil
+	}
 
-		if err := p.storage.MarkAsPublished(ctx, event.Data().ID); err != nil {
+	for _, id := range published {
+		if err := p.storage.MarkAsPublished(ctx, id); err != nil {
 			p.logger.Error("failed to mark event as published", lf.Err(err))
 			continue
 		}
@@ -5,69 +5,274 @@ import (
 	"errors"
 	"fmt"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/rabbitmq/amqp091-go"
+	"github.com/raphoester/x/xerrs"
 	"github.com/raphoester/x/xevents"
 	"github.com/raphoester/x/xlog"
 	"github.com/raphoester/x/xlog/lf"
 	"github.com/raphoester/x/xrabbitmq"
+	"github.com/raphoester/x/xtime"
 )
 
-func New(client *xrabbitmq.Client, logger xlog.Logger) (*Broker, error) {
-	return &Broker{
+func New(client *xrabbitmq.Client, logger xlog.Logger, opts ...Option) (*Broker, error) {
+	b := &Broker{
 		rabbitMQ:       client,
 		logger:         logger,
 		consumersCount: runtime.GOMAXPROCS(0),
-	}, nil
+		topics:         xevents.DefaultTopicRegistry(),
+		clock:          xtime.RealProvider{},
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	return b, nil
 }
 
 type Broker struct {
 	rabbitMQ       *xrabbitmq.Client
 	logger         xlog.Logger
 	consumersCount int
+	topics         *xevents.TopicRegistry
+	middlewares    []xevents.Middleware
+	clock          xtime.Provider
+}
+
+type Option func(*Broker)
+
+// WithTopicRegistry sets the registry used to decode the payloads of received events.
+//
+// Defaults to xevents.DefaultTopicRegistry.
+func WithTopicRegistry(registry *xevents.TopicRegistry) Option {
+	return func(b *Broker) {
+		b.topics = registry
+	}
+}
+
+// WithTimeProvider sets the clock telling whether the events are delayed, and how long for (see PublishAt).
+//
+// Defaults to the real time.
+func WithTimeProvider(provider xtime.Provider) Option {
+	return func(b *Broker) {
+		b.clock = provider
+	}
+}
+
+// WithMiddlewares wraps every handler given to Listen with the middlewares,
+// outside of the middlewares set on the handler pairs themselves.
+func WithMiddlewares(middlewares ...xevents.Middleware) Option {
+	return func(b *Broker) {
+		b.middlewares = append(b.middlewares, middlewares...)
+	}
 }
 
 func (b *Broker) Publish(ctx context.Context, event *xevents.Event) error {
+	if deliverAfter := event.Data().DeliverAfter; deliverAfter.After(b.clock.Now()) {
+		return b.PublishAt(ctx, event, deliverAfter)
+	}
+
+	payload, err := toPayload(event)
+	if err != nil {
+		return err
+	}
+
+	if err := b.rabbitMQ.Publish(ctx, payload); err != nil {
+		return fmt.Errorf("failed to push event: %w", err)
+	}
+
+	return nil
+}
+
+// PublishAt publishes the event so that it is delivered at the given time, see xrabbitmq.Client.PublishAt.
+func (b *Broker) PublishAt(ctx context.Context, event *xevents.Event, at time.Time) error {
+	payload, err := toPayload(event)
+	if err != nil {
+		return err
+	}
+
+	if err := b.rabbitMQ.PublishAfter(ctx, payload, at.Sub(b.clock.Now())); err != nil {
+		return fmt.Errorf("failed to push delayed event: %w", err)
+	}
+
+	return nil
+}
+
+func (b *Broker) PublishAfter(ctx context.Context, event *xevents.Event, delay time.Duration) error {
+	return b.PublishAt(ctx, event, b.clock.Now().Add(delay))
+}
+
+// publishDelayed publishes a delayed event of a batch, waiting for the broker to confirm it.
+func (b *Broker) publishDelayed(ctx context.Context, event *xevents.Event, delay time.Duration) error {
+	payload, err := toPayload(event)
+	if err != nil {
+		return err
+	}
+
+	err = b.rabbitMQ.PublishBatchAfter(ctx, delay, payload)
+
+	var batchErr *xrabbitmq.BatchError
+	if errors.As(err, &batchErr) {
+		err = batchErr.Errors[0]
+	}
+	if err != nil {
+		return fmt.Errorf("failed to push delayed event: %w", err)
+	}
+
+	return nil
+}
+
+// PublishBatch publishes the events in a row, and waits for the broker to confirm them once for the whole batch.
+func (b *Broker) PublishBatch(ctx context.Context, events ...*xevents.Event) error {
+	failed := make(map[string]error)
+	payloads := make([]xrabbitmq.Payload, 0, len(events))
+	ids := make([]string, 0, len(events))
+	for _, event := range events {
+		// delayed events don't go through the exchange right away, they are confirmed on their own
+		if deliverAfter := event.Data().DeliverAfter; deliverAfter.After(b.clock.Now()) {
+			if err := b.publishDelayed(ctx, event, deliverAfter.Sub(b.clock.Now())); err != nil {
+				failed[event.Data().ID] = err
+			}
+			continue
+		}
+
+		payload, err := toPayload(event)
+		if err != nil {
+			failed[event.Data().ID] = err
+			continue
+		}
+		payloads = append(payloads, payload)
+		ids = append(ids, event.Data().ID)
+	}
+
+	err := b.rabbitMQ.PublishBatch(ctx, payloads...)
+
+	var batchErr *xrabbitmq.BatchError
+	if errors.As(err, &batchErr) {
+		for i, err := range batchErr.Errors {
+			if err != nil {
+				failed[ids[i]] = fmt.Errorf("failed to push event: %w", err)
+			}
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to push events: %w", err)
+	}
+
+	if len(failed) > 0 {
+		return &xevents.BatchError{Errors: failed}
+	}
+
+	return nil
+}
+
+func toPayload(event *xevents.Event) (xrabbitmq.Payload, error) {
 	marshaledPayload, err := event.MarshalPayload()
 	if err != nil {
-		return fmt.Errorf("failed to marshal event payload: %w", err)
+		return xrabbitmq.Payload{}, fmt.Errorf("failed to marshal event payload: %w", err)
 	}
 
-	if err := b.rabbitMQ.Publish(ctx, xrabbitmq.Payload{
+	payload := xrabbitmq.Payload{
 		Topic:       event.Data().Topic,
-		ContentType: "application/json",
+		ContentType: contentType(event),
 		MessageID:   event.Data().ID,
 		Timestamp:   event.Data().CreatedAt,
+		Headers:     eventHeaders(event),
 		Body:        marshaledPayload,
-	}); err != nil {
-		return fmt.Errorf("failed to push event: %w", err)
 	}
+	setProperties(&payload, event.Data().Metadata)
 
-	return nil
+	return payload, nil
 }
 
-func (b *Broker) Listen(ctx context.Context, identifier string, routingKeys []string, pairs ...xevents.HandlerPair) error {
+// propertiesMetadata are the metadata keys carried by the AMQP properties rather than by headers.
+var propertiesMetadata = []string{
+	xevents.MetadataReplyTo,
+	xevents.MetadataPriority,
+	xevents.MetadataExpiration,
+	xevents.MetadataMessageType,
+	xevents.MetadataAppID,
+	xevents.MetadataUserID,
+}
+
+// setProperties maps the metadata to the AMQP properties. The correlation ID stays in the headers as well,
+// for the consumers reading it from there. Invalid priorities and expirations are ignored.
+func setProperties(payload *xrabbitmq.Payload, metadata xevents.Metadata) {
+	payload.CorrelationID = metadata.CorrelationID()
+	payload.ReplyTo = metadata.ReplyTo()
+	payload.Type = metadata.MessageType()
+	payload.AppID = metadata.AppID()
+	payload.UserID = metadata.UserID()
+
+	if priority, err := strconv.ParseUint(metadata.Priority(), 10, 8); err == nil {
+		payload.Priority = uint8(priority)
+	}
+
+	if ms, err := strconv.ParseInt(metadata.Expiration(), 10, 64); err == nil && ms > 0 {
+		payload.Expiration = time.Duration(ms) * time.Millisecond
+	}
+}
+
+// deliveryMetadata restores the event's metadata from the headers and the AMQP properties of the delivery.
+// Headers have precedence, so that messages published with both keep the value of their header.
+func deliveryMetadata(delivery amqp091.Delivery) xevents.Metadata {
+	metadata := headersToMetadata(delivery.Headers)
+
+	payload := xrabbitmq.PayloadFromDelivery(delivery)
+	properties := xevents.Metadata{
+		xevents.MetadataCorrelationID: payload.CorrelationID,
+		xevents.MetadataReplyTo:       payload.ReplyTo,
+		xevents.MetadataMessageType:   payload.Type,
+		xevents.MetadataAppID:         payload.AppID,
+		xevents.MetadataUserID:        payload.UserID,
+	}
+	if payload.Priority > 0 {
+		properties[xevents.MetadataPriority] = strconv.Itoa(int(payload.Priority))
+	}
+	if payload.Expiration > 0 {
+		properties[xevents.MetadataExpiration] = strconv.FormatInt(payload.Expiration.Milliseconds(), 10)
+	}
+
+	for k, v := range properties {
+		if _, ok := metadata[k]; !ok && v != "" {
+			metadata[k] = v
+		}
+	}
+
+	return metadata
+}
+
+// Listen consumes the queue named after the identifier, bound to the routing keys.
+//
+// Unless set by the options, the subscription runs as many consumers as the broker's default.
+// Partitioned subscriptions (see xevents.WithPartitions) need the rabbitmq_consistent_hash_exchange plugin.
+// Replayable subscriptions (see xevents.WithReplay) consume a stream queue with a single consumer.
+func (b *Broker) Listen(ctx context.Context, identifier string, routingKeys []string, pairs []xevents.HandlerPair, opts ...xevents.ListenOption) (xevents.Subscription, error) {
 	if len(pairs) == 0 {
-		return errors.New("cannot listen without any handler pairs")
+		return nil, errors.New("cannot listen without any handler pairs")
 	}
 
 	if len(routingKeys) == 0 {
-		return errors.New("cannot listen without any routing keys")
+		return nil, errors.New("cannot listen without any routing keys")
+	}
+
+	if err := b.topics.CheckPairs(pairs...); err != nil {
+		return nil, fmt.Errorf("cannot listen on unregistered topics: %w", err)
 	}
 
 	handlerMap := make(map[string]xevents.Handler)
-	for _, pair := range pairs {
+	for _, pair := range xevents.WrapPairs(pairs, b.middlewares...) {
 		handlerMap[pair.Topic] = pair.Handler
 	}
 
-	ready := make(chan struct{})
-
-	go b.rabbitMQ.Stream(
+	stream, err := b.rabbitMQ.Stream(
 		ctx,
 		identifier,
 		routingKeys,
-		ready,
-		b.consumersCount,
 		func(ctx context.Context, delivery amqp091.Delivery) error {
 			handler, ok := handlerMap[delivery.RoutingKey]
 			if !ok {
@@ -84,20 +289,164 @@ func (b *Broker) Listen(ctx context.Context, identifier string, routingKeys []st
 				delivery.Timestamp.UTC(),
 				delivery.RoutingKey,
 				delivery.Body,
+				xevents.WithContentType(delivery.ContentType),
+				xevents.WithSchemaVersion(schemaVersion(delivery.Headers)),
+				xevents.WithMetadata(deliveryMetadata(delivery)),
 			)
 
-			if err := handler(ctx, event); err != nil {
+			event, err := b.topics.Decode(event)
+			if err != nil {
+				return xerrs.Permanent(fmt.Errorf("failed to decode event: %w", err))
+			}
+
+			ctx = xevents.ContextWithDeliveryAttempt(ctx, xrabbitmq.DeliveryAttempt(delivery))
+			if offset, ok := xrabbitmq.DeliveryOffset(delivery); ok {
+				ctx = xevents.ContextWithReplayOffset(ctx, offset)
+			}
+			if err := handler(xevents.ContextFromEvent(ctx, event), event); err != nil {
 				return fmt.Errorf("handler returned an error: %w", err)
 			}
 
 			return nil
 		},
+		b.streamOptions(xevents.NewListenOptions(opts...))...,
 	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start consuming: %w", err)
+	}
+
+	return stream, nil
+}
+
+// streamOptions maps the listen options, unless set the stream runs as many consumers as the broker's default.
+func (b *Broker) streamOptions(options xevents.ListenOptions) []xrabbitmq.StreamOption {
+	consumers := b.consumersCount
+	if options.Concurrency > 0 {
+		consumers = options.Concurrency
+	}
+
+	if options.Replay.Enabled {
+		queue := queueOptions(options.Queue)
+		queue.Stream = true
+		queue.MaxAge = options.Replay.MaxAge
+
+		return []xrabbitmq.StreamOption{
+			xrabbitmq.WithPrefetch(options.Prefetch),
+			xrabbitmq.WithQueueOptions(queue),
+			xrabbitmq.WithOffset(replayOffset(options.Replay.From)),
+			xrabbitmq.WithOffsetTracking(options.Replay.Checkpoint),
+		}
+	}
+
+	return []xrabbitmq.StreamOption{
+		xrabbitmq.WithConsumers(consumers),
+		xrabbitmq.WithPrefetch(options.Prefetch),
+		xrabbitmq.WithPartitions(options.Partitions),
+		xrabbitmq.WithQueueOptions(queueOptions(options.Queue)),
+	}
+}
+
+// replayOffset maps a position in the log of a replayable subscription to an offset in its stream queue.
+func replayOffset(position xevents.ReplayPosition) xrabbitmq.Offset {
+	switch position.Kind {
+	case xevents.ReplayFirst:
+		return xrabbitmq.OffsetFirst()
+	case xevents.ReplayLast:
+		return xrabbitmq.OffsetLast()
+	case xevents.ReplayOffset:
+		return xrabbitmq.OffsetAt(position.Offset)
+	case xevents.ReplayTime:
+		return xrabbitmq.OffsetFrom(position.Time)
+	default:
+		return xrabbitmq.OffsetNext()
+	}
+}
+
+// DeadLetters lists the events that exhausted their delivery attempts on the listener's queue.
+func (b *Broker) DeadLetters(ctx context.Context, identifier string, limit int) ([]xrabbitmq.DeadLetter, error) {
+	return b.rabbitMQ.DeadLetters(ctx, identifier, limit)
+}
+
+// Redrive publishes dead-lettered events of the listener's queue back to their original topic.
+// All of them are re-driven if no event ID is given.
+func (b *Broker) Redrive(ctx context.Context, identifier string, eventIDs ...string) (int, error) {
+	return b.rabbitMQ.Redrive(ctx, identifier, eventIDs...)
+}
+
+func contentType(event *xevents.Event) string {
+	if ct := event.Data().ContentType; ct != "" {
+		return ct
+	}
+	return xevents.ContentTypeJSON
+}
+
+const schemaVersionHeader = "x-schema-version"
+
+// eventHeaders exposes the event's metadata as AMQP headers, one header per key,
+// alongside the schema version of its payload.
+func eventHeaders(event *xevents.Event) amqp091.Table {
+	metadata := event.Data().Metadata
+	headers := metadataHeaders(metadata)
+	headers[schemaVersionHeader] = int32(event.Data().SchemaVersion)
+
+	// events without ordering key are spread evenly across the partitions of partitioned subscriptions
+	orderingKey := metadata.OrderingKey()
+	if orderingKey == "" {
+		orderingKey = event.Data().ID
+	}
+	headers[xrabbitmq.HeaderOrderingKey] = orderingKey
+
+	return headers
+}
+
+func metadataHeaders(metadata xevents.Metadata) amqp091.Table {
+	headers := make(amqp091.Table, len(metadata)+2)
+	for k, v := range metadata {
+		if slices.Contains(propertiesMetadata, k) {
+			continue
+		}
+		headers[k] = v
+	}
+	return headers
+}
+
+func schemaVersion(headers amqp091.Table) int {
+	switch v := headers[schemaVersionHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
+	}
+}
+
+// headersToMetadata restores the event's metadata from the delivery's headers.
+//
+// Only string headers are kept, others are set by the broker itself and are not part of the event.
+// The same goes for the "x-" headers, which are reserved to the broker and the client (see xrabbitmq.HeaderAttempt).
+func headersToMetadata(headers amqp091.Table) xevents.Metadata {
+	metadata := make(xevents.Metadata, len(headers))
+	for k, v := range headers {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		if str, ok := v.(string); ok {
+			metadata[k] = str
+		}
+	}
+	return metadata
+}
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-ready:
-		return nil
+func queueOptions(options xevents.QueueOptions) xrabbitmq.QueueOptions {
+	return xrabbitmq.QueueOptions{
+		Durable:    options.Durable,
+		Quorum:     options.Quorum,
+		Exclusive:  options.Exclusive,
+		AutoDelete: options.AutoDelete,
+		MessageTTL: options.MessageTTL,
+		MaxLength:  options.MaxLength,
 	}
 }
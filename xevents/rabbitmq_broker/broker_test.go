@@ -3,6 +3,7 @@ package rabbitmq_broker_test
 import (
 	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 	"github.com/raphoester/x/xevents/rabbitmq_broker"
 	"github.com/raphoester/x/xid"
 	"github.com/raphoester/x/xlog"
+	"github.com/raphoester/x/xrabbitmq"
 	"github.com/raphoester/x/xtime"
 	"github.com/stretchr/testify/suite"
 )
@@ -53,10 +55,16 @@ func (s *testSuite) TestPublish() {
 	timeProvider := xtime.NewDefaultFixedProvider()
 	idGenerator := xid.NewDefaultFixedGenerator()
 	expectedEventData := xevents.EventData{
-		ID:        idGenerator.Generate(),
-		CreatedAt: timeProvider.Now(),
-		Topic:     customTopicName,
-		Payload:   nil, // type is dynamic, can't perform assertion on it
+		ID:            idGenerator.Generate(),
+		CreatedAt:     timeProvider.Now(),
+		Topic:         customTopicName,
+		Payload:       nil, // type is dynamic, can't perform assertion on it
+		ContentType:   xevents.ContentTypeJSON,
+		SchemaVersion: 1,
+		Metadata: xevents.Metadata{
+			xevents.MetadataCorrelationID: idGenerator.Generate(),
+			xevents.MetadataTenant:        "tenant",
+		},
 	}
 
 	ran := false
@@ -67,11 +75,11 @@ func (s *testSuite) TestPublish() {
 	listenCtx, cancelListen := context.WithCancel(context.Background())
 	defer cancelListen()
 
-	err := s.broker.Listen(
+	_, err := s.broker.Listen(
 		listenCtx,
 		"test",
 		[]string{customTopicName},
-		xevents.HandlerPair{
+		[]xevents.HandlerPair{{
 			Topic: customTopicName, // route the event to its own handler through its topic name
 			Handler: xevents.UnmarshalHelper(
 				func(ctx context.Context, event *xevents.Event, payload *xevents.ExamplePayload) error {
@@ -82,13 +90,14 @@ func (s *testSuite) TestPublish() {
 					return nil
 				},
 			),
-		},
+		}},
 	)
 	s.Require().NoError(err)
 
 	valueShouldBe := "value"
 
 	event, err := xevents.New(
+		xevents.WithTenant(context.Background(), "tenant"),
 		timeProvider,
 		idGenerator,
 		xevents.ExamplePayload{Key: "value"}.WithTopic(customTopicName),
@@ -143,18 +152,19 @@ func (s *testSuite) TestStreamOnlyAPartOfThePublishedEvents() {
 	// need to cancel the listener context to stop the test at the end
 	listenCtx, cancelListen := context.WithCancel(context.Background())
 	defer cancelListen()
-	err := s.broker.Listen(listenCtx, "test", []string{"topic.*"}, pairs...)
+	_, err := s.broker.Listen(listenCtx, "test", []string{"topic.*"}, pairs)
 	s.Assert().NoError(err)
 
 	for key := range expectedKeysSet {
 		expectedKeysSet[key] = struct{}{}
-		event, err := xevents.New(timeProvider, idGenerator, xevents.ExamplePayload{Key: key}.WithTopic(key))
+		event, err := xevents.New(context.Background(), timeProvider, idGenerator, xevents.ExamplePayload{Key: key}.WithTopic(key))
 		s.Require().NoError(err)
 		err = s.broker.Publish(context.Background(), event)
 		s.Require().NoError(err)
 	}
 
 	event, err := xevents.New(
+		context.Background(),
 		timeProvider,
 		idGenerator,
 		xevents.ExamplePayload{Key: "value"}.WithTopic("xyz.not.matching.topic.name"),
@@ -177,21 +187,65 @@ func (s *testSuite) TestStreamOnlyAPartOfThePublishedEvents() {
 	s.Assert().Equal(expectedKeysSet, retrievedKeysSet)
 }
 
+func (s *testSuite) TestUndecodableEventIsNotRequeued() {
+	registry := xevents.NewTopicRegistry()
+	s.Require().NoError(xevents.Register[xevents.ExamplePayload](registry, "topic.undecodable"))
+	broker, err := rabbitmq_broker.New(s.rabbitMQ.RabbitMQ, xlog.NewTestLogger(s.T()), rabbitmq_broker.WithTopicRegistry(registry))
+	s.Require().NoError(err)
+
+	handled := make(chan string, 1)
+	subscription, err := broker.Listen(context.Background(), "test.undecodable", []string{"topic.undecodable"}, []xevents.HandlerPair{{
+		Topic: "topic.undecodable",
+		Handler: xevents.UnmarshalHelper(func(ctx context.Context, event *xevents.Event, payload xevents.ExamplePayload) error {
+			handled <- payload.Key
+			return nil
+		}),
+	}})
+	s.Require().NoError(err)
+
+	s.Require().NoError(s.rabbitMQ.RabbitMQ.Publish(context.Background(), xrabbitmq.Payload{
+		Topic:       "topic.undecodable",
+		MessageID:   "undecodable",
+		ContentType: "application/json",
+		Body:        []byte("not json"),
+	}))
+
+	event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: "value"}.WithTopic("topic.undecodable"))
+	s.Require().NoError(err)
+	s.Require().NoError(broker.Publish(context.Background(), event))
+
+	select {
+	case key := <-handled:
+		s.Assert().Equal("value", key)
+	case <-time.After(10 * time.Second):
+		s.FailNow("event not handled")
+	}
+	s.Require().NoError(subscription.Stop(context.Background()))
+
+	ch, err := s.rabbitMQ.RabbitMQ.Connection().GetChannel()
+	s.Require().NoError(err)
+	defer func() { _ = ch.Close() }()
+
+	queue, err := ch.QueueDeclarePassive("test.undecodable", false, false, false, false, nil)
+	s.Require().NoError(err)
+	s.Assert().Zero(queue.Messages, "the undecodable message was dropped rather than requeued")
+}
+
 func (s *testSuite) TestListenTwice() {
-	err := s.broker.Listen(context.Background(), "test", []string{"topic1"}, xevents.HandlerPair{
+	_, err := s.broker.Listen(context.Background(), "test", []string{"topic1"}, []xevents.HandlerPair{{
 		Topic: "topic1",
 		Handler: func(ctx context.Context, event *xevents.Event) error {
 			return nil
 		},
-	})
+	}})
 	s.Assert().NoError(err)
 
-	err = s.broker.Listen(context.Background(), "test", []string{"topic2"}, xevents.HandlerPair{
+	_, err = s.broker.Listen(context.Background(), "test", []string{"topic2"}, []xevents.HandlerPair{{
 		Topic: "topic2",
 		Handler: func(ctx context.Context, event *xevents.Event) error {
 			return nil
 		},
-	})
+	}})
 	s.Assert().NoError(err)
 
 }
@@ -202,29 +256,29 @@ func (s *testSuite) TestListenOnMultipleKeys() {
 	ranTopicB := false
 	ranTopicC := false
 
-	err := s.broker.Listen(context.Background(), "test", []string{"topic.a.*", "topic.b.*"}, xevents.HandlerPair{
+	_, err := s.broker.Listen(context.Background(), "test", []string{"topic.a.*", "topic.b.*"}, []xevents.HandlerPair{{
 		Topic: "topic.a.test",
 		Handler: func(ctx context.Context, event *xevents.Event) error {
 			ranTopicA = true
 			return nil
 		},
-	}, xevents.HandlerPair{
+	}, {
 		Topic: "topic.b.test",
 		Handler: func(ctx context.Context, event *xevents.Event) error {
 			ranTopicB = true
 			return nil
 		},
-	}, xevents.HandlerPair{ // this one should not be called
+	}, { // this one should not be called
 		Topic: "topic.c.test",
 		Handler: func(ctx context.Context, event *xevents.Event) error {
 			ranTopicC = true
 			return nil
 		},
-	})
+	}})
 	s.Assert().NoError(err)
 
 	makeEvent := func(key, topic string) *xevents.Event {
-		event, err := xevents.New(xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: key}.WithTopic(topic))
+		event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: key}.WithTopic(topic))
 		s.Require().NoError(err)
 		return event
 	}
@@ -258,3 +312,305 @@ func (s *testSuite) TestListenOnMultipleKeys() {
 	s.Assert().True(ranTopicB)
 	s.Assert().False(ranTopicC)
 }
+
+func (s *testSuite) TestStopWaitsForRunningHandlers() {
+	started := make(chan struct{})
+	finished := false
+
+	subscription, err := s.broker.Listen(context.Background(), "test", []string{"topic.stop"}, []xevents.HandlerPair{{
+		Topic: "topic.stop",
+		Handler: func(ctx context.Context, event *xevents.Event) error {
+			close(started)
+			time.Sleep(500 * time.Millisecond)
+			finished = true
+			return nil
+		},
+	}})
+	s.Require().NoError(err)
+
+	event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: "value"}.WithTopic("topic.stop"))
+	s.Require().NoError(err)
+	s.Require().NoError(s.broker.Publish(context.Background(), event))
+
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		s.FailNow("handler was not called")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Require().NoError(subscription.Stop(ctx))
+	s.Assert().True(finished)
+}
+
+func (s *testSuite) TestStopReportsConsumerFailure() {
+	config := xrabbitmq.Config{}
+	config.ResetToDefault()
+	config.URL = s.rabbitMQ.URL
+	client, err := xrabbitmq.NewClient(xlog.NewTestLogger(s.T()), config)
+	s.Require().NoError(err)
+
+	broker, err := rabbitmq_broker.New(client, xlog.NewTestLogger(s.T()))
+	s.Require().NoError(err)
+
+	subscription, err := broker.Listen(context.Background(), "test.failure", []string{"topic.failure"}, []xevents.HandlerPair{{
+		Topic:   "topic.failure",
+		Handler: func(ctx context.Context, event *xevents.Event) error { return nil },
+	}})
+	s.Require().NoError(err)
+
+	// the consumers can't recover once the connection is closed for good
+	s.Require().NoError(client.Close())
+	select {
+	case <-subscription.(*xrabbitmq.Stream).Done():
+	case <-time.After(10 * time.Second):
+		s.FailNow("subscription did not fail")
+	}
+
+	s.Assert().Error(subscription.Stop(context.Background()))
+}
+
+func (s *testSuite) TestListenWithOptions() {
+	handled := make(chan struct{}, 1)
+
+	subscription, err := s.broker.Listen(context.Background(), "test.options", []string{"topic.options"}, []xevents.HandlerPair{{
+		Topic: "topic.options",
+		Handler: func(ctx context.Context, event *xevents.Event) error {
+			handled <- struct{}{}
+			return nil
+		},
+	}},
+		xevents.WithConcurrency(2),
+		xevents.WithPrefetch(1),
+		xevents.WithQuorumQueue(),
+		xevents.WithMessageTTL(time.Minute),
+		xevents.WithMaxLength(100),
+	)
+	s.Require().NoError(err)
+	defer func() { _ = subscription.Stop(context.Background()) }()
+
+	event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: "value"}.WithTopic("topic.options"))
+	s.Require().NoError(err)
+	s.Require().NoError(s.broker.Publish(context.Background(), event))
+
+	select {
+	case <-handled:
+	case <-time.After(10 * time.Second):
+		s.Fail("handler was not called")
+	}
+
+	_, err = s.broker.Listen(context.Background(), "test.options.invalid", []string{"topic.options"}, []xevents.HandlerPair{{
+		Topic: "topic.options",
+		Handler: func(ctx context.Context, event *xevents.Event) error {
+			return nil
+		},
+	}}, xevents.WithQuorumQueue(), xevents.WithExclusiveQueue())
+	s.Assert().Error(err)
+}
+
+func (s *testSuite) TestPartitionedListenKeepsOrderPerKey() {
+	var mu sync.Mutex
+	handled := make(map[string][]string)
+	count := 0
+
+	subscription, err := s.broker.Listen(context.Background(), "test.partitioned", []string{"topic.partitioned"}, []xevents.HandlerPair{{
+		Topic: "topic.partitioned",
+		Handler: xevents.UnmarshalHelper(func(ctx context.Context, event *xevents.Event, payload xevents.ExamplePayload) error {
+			mu.Lock()
+			defer mu.Unlock()
+			key := event.Data().Metadata.OrderingKey()
+			handled[key] = append(handled[key], payload.Key)
+			count++
+			return nil
+		}),
+	}}, xevents.WithPartitions(3))
+	s.Require().NoError(err)
+	defer func() { _ = subscription.Stop(context.Background()) }()
+
+	expected := make(map[string][]string)
+	for i := range 10 {
+		for _, aggregate := range []string{"a", "b", "c", "d"} {
+			key := fmt.Sprintf("%s%d", aggregate, i)
+			expected[aggregate] = append(expected[aggregate], key)
+
+			event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: key}.WithTopic("topic.partitioned").WithOrderingKey(aggregate))
+			s.Require().NoError(err)
+			s.Require().NoError(s.broker.Publish(context.Background(), event))
+		}
+	}
+
+	s.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return count == 40
+	}, 10*time.Second, 100*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	s.Assert().Equal(expected, handled)
+}
+
+func (s *testSuite) TestPublishBatch() {
+	var mu sync.Mutex
+	handled := make([]string, 0)
+
+	subscription, err := s.broker.Listen(context.Background(), "test.batch", []string{"topic.batch"}, []xevents.HandlerPair{{
+		Topic: "topic.batch",
+		Handler: xevents.UnmarshalHelper(func(ctx context.Context, event *xevents.Event, payload xevents.ExamplePayload) error {
+			mu.Lock()
+			defer mu.Unlock()
+			handled = append(handled, payload.Key)
+			return nil
+		}),
+	}}, xevents.WithConcurrency(1))
+	s.Require().NoError(err)
+	defer func() { _ = subscription.Stop(context.Background()) }()
+
+	events := make([]*xevents.Event, 0)
+	expected := make([]string, 0)
+	for i := range 20 {
+		key := fmt.Sprintf("key%d", i)
+		event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: key}.WithTopic("topic.batch"))
+		s.Require().NoError(err)
+		events = append(events, event)
+		expected = append(expected, key)
+	}
+
+	s.Require().NoError(s.broker.PublishBatch(context.Background(), events...))
+
+	s.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == len(expected)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	s.Assert().Equal(expected, handled)
+}
+
+func (s *testSuite) TestMessageProperties() {
+	received := make(chan xevents.Metadata, 1)
+	subscription, err := s.broker.Listen(context.Background(), "test.properties", []string{"topic.properties"}, []xevents.HandlerPair{{
+		Topic: "topic.properties",
+		Handler: func(ctx context.Context, event *xevents.Event) error {
+			received <- event.Data().Metadata
+			return nil
+		},
+	}})
+	s.Require().NoError(err)
+	defer func() { _ = subscription.Stop(context.Background()) }()
+
+	ctx := xevents.ContextWithMetadata(context.Background(), xevents.Metadata{
+		xevents.MetadataReplyTo:     "replies",
+		xevents.MetadataPriority:    "3",
+		xevents.MetadataExpiration:  "60000",
+		xevents.MetadataMessageType: "example",
+		xevents.MetadataAppID:       "billing",
+		xevents.MetadataUserID:      "guest",
+	})
+	event, err := xevents.New(ctx, xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{}.WithTopic("topic.properties"))
+	s.Require().NoError(err)
+	s.Require().NoError(s.broker.Publish(context.Background(), event))
+
+	select {
+	case md := <-received:
+		s.Assert().Equal(event.Data().Metadata, md)
+	case <-time.After(10 * time.Second):
+		s.Fail("event not received")
+	}
+}
+
+func (s *testSuite) TestReplayableListen() {
+	listen := func(handled chan<- string, opts ...xevents.ListenOption) xevents.Subscription {
+		subscription, err := s.broker.Listen(context.Background(), "test.replay", []string{"topic.replay"}, []xevents.HandlerPair{{
+			Topic: "topic.replay",
+			Handler: xevents.UnmarshalHelper(func(ctx context.Context, event *xevents.Event, payload xevents.ExamplePayload) error {
+				offset, ok := xevents.ReplayOffsetOf(ctx)
+				s.Assert().True(ok)
+				handled <- fmt.Sprintf("%s@%d", payload.Key, offset)
+				return nil
+			}),
+		}}, opts...)
+		s.Require().NoError(err)
+		return subscription
+	}
+
+	receive := func(handled <-chan string, count int) []string {
+		keys := make([]string, 0, count)
+		for range count {
+			select {
+			case key := <-handled:
+				keys = append(keys, key)
+			case <-time.After(10 * time.Second):
+				s.FailNow("events not handled", "got %v", keys)
+			}
+		}
+		return keys
+	}
+
+	handled := make(chan string, 10)
+	subscription := listen(handled, xevents.WithReplay(xevents.ReplayFromFirst()), xevents.WithCheckpoint("projection"))
+	for i := range 3 {
+		event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: fmt.Sprintf("key%d", i)}.WithTopic("topic.replay"))
+		s.Require().NoError(err)
+		s.Require().NoError(s.broker.Publish(context.Background(), event))
+	}
+	s.Assert().Equal([]string{"key0@0", "key1@1", "key2@2"}, receive(handled, 3))
+	s.Require().NoError(subscription.Stop(context.Background()))
+
+	// a new projection rebuilds from the events already handled
+	subscription = listen(handled, xevents.WithReplay(xevents.ReplayFromOffset(1)))
+	s.Assert().Equal([]string{"key1@1", "key2@2"}, receive(handled, 2))
+	s.Require().NoError(subscription.Stop(context.Background()))
+
+	event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: "key3"}.WithTopic("topic.replay"))
+	s.Require().NoError(err)
+	s.Require().NoError(s.broker.Publish(context.Background(), event))
+
+	// while the checkpoint resumes after the last handled event
+	subscription = listen(handled, xevents.WithReplay(xevents.ReplayFromFirst()), xevents.WithCheckpoint("projection"))
+	s.Assert().Equal([]string{"key3@3"}, receive(handled, 1))
+	s.Require().NoError(subscription.Stop(context.Background()))
+}
+
+type quoteRequest struct {
+	Product  string `json:"product"`
+	Quantity int    `json:"quantity"`
+}
+
+type quoteReply struct {
+	Price  int    `json:"price"`
+	Tenant string `json:"tenant"`
+}
+
+func (s *testSuite) TestRequestReply() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	subscription, err := rabbitmq_broker.Serve(ctx, s.broker, "quotes.get", func(ctx context.Context, request quoteRequest) (quoteReply, error) {
+		if request.Quantity <= 0 {
+			return quoteReply{}, fmt.Errorf("invalid quantity %d", request.Quantity)
+		}
+
+		return quoteReply{
+			Price:  request.Quantity * 3,
+			Tenant: xevents.MetadataFromContext(ctx).Tenant(),
+		}, nil
+	})
+	s.Require().NoError(err)
+	defer func() { _ = subscription.Stop(context.Background()) }()
+
+	reply, err := rabbitmq_broker.Request[quoteReply](xevents.WithTenant(ctx, "tenant"), s.broker, "quotes.get", quoteRequest{Product: "apple", Quantity: 4})
+	s.Require().NoError(err)
+	s.Assert().Equal(quoteReply{Price: 12, Tenant: "tenant"}, reply)
+
+	_, err = rabbitmq_broker.Request[quoteReply](ctx, s.broker, "quotes.get", quoteRequest{Product: "apple"})
+	var remoteErr *xrabbitmq.RemoteError
+	s.Require().ErrorAs(err, &remoteErr)
+	s.Assert().Equal("invalid quantity 0", remoteErr.Message)
+
+	_, err = rabbitmq_broker.Request[quoteReply](ctx, s.broker, "quotes.unknown", quoteRequest{})
+	s.Assert().ErrorIs(err, xrabbitmq.ErrUnroutable)
+}
@@ -0,0 +1,23 @@
+package rabbitmq_broker
+
+import (
+	"testing"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xrabbitmq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeadersToMetadataStripsBrokerHeaders(t *testing.T) {
+	metadata := headersToMetadata(amqp091.Table{
+		xevents.MetadataTenant:             "tenant",
+		xrabbitmq.HeaderAttempt:            int32(2),
+		xrabbitmq.HeaderLastError:          "handler failed",
+		xrabbitmq.HeaderOriginalRoutingKey: "topic",
+		xrabbitmq.HeaderOriginalExchange:   "exchange",
+		"x-schema-version":                 "2",
+	})
+
+	assert.Equal(t, xevents.Metadata{xevents.MetadataTenant: "tenant"}, metadata)
+}
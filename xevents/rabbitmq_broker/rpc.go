@@ -0,0 +1,96 @@
+package rabbitmq_broker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xrabbitmq"
+)
+
+// Request sends the request to the server of the topic (see Serve) and decodes its reply.
+//
+// The request is encoded like event payloads (see xevents.ContentTypeOf), and carries the metadata of the context.
+// Errors returned by the server's handler are returned as a *xrabbitmq.RemoteError.
+func Request[Res any, Req any](ctx context.Context, b *Broker, topic string, request Req) (Res, error) {
+	var res Res
+
+	contentType := xevents.ContentTypeOf(request)
+	codec, err := xevents.DefaultCodecs().Get(contentType)
+	if err != nil {
+		return res, err
+	}
+
+	body, err := codec.Marshal(request)
+	if err != nil {
+		return res, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	reply, err := b.rabbitMQ.Request(ctx, topic, xrabbitmq.Payload{
+		ContentType: contentType,
+		Headers:     metadataHeaders(xevents.MetadataFromContext(ctx)),
+		Body:        body,
+	})
+	if err != nil {
+		return res, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	codec, err = xevents.DefaultCodecs().Get(reply.ContentType)
+	if err != nil {
+		return res, err
+	}
+
+	if err := codec.Unmarshal(reply.Body, &res); err != nil {
+		return res, fmt.Errorf("failed to unmarshal reply: %w", err)
+	}
+
+	return res, nil
+}
+
+// Serve replies to the requests sent on the topic (see Request) with what the handler returns.
+//
+// The handler's context carries the metadata of the request, and expires along with it.
+// Options are applied like with Listen.
+func Serve[Req any, Res any](
+	ctx context.Context,
+	b *Broker,
+	topic string,
+	handler func(ctx context.Context, request Req) (Res, error),
+	opts ...xevents.ListenOption,
+) (xevents.Subscription, error) {
+	stream, err := b.rabbitMQ.Serve(ctx, topic, func(ctx context.Context, request xrabbitmq.Payload) (xrabbitmq.Payload, error) {
+		codec, err := xevents.DefaultCodecs().Get(request.ContentType)
+		if err != nil {
+			return xrabbitmq.Payload{}, err
+		}
+
+		var req Req
+		if err := codec.Unmarshal(request.Body, &req); err != nil {
+			return xrabbitmq.Payload{}, fmt.Errorf("failed to unmarshal request: %w", err)
+		}
+
+		ctx = xevents.ContextWithMetadata(ctx, headersToMetadata(request.Headers))
+		res, err := handler(ctx, req)
+		if err != nil {
+			return xrabbitmq.Payload{}, err
+		}
+
+		contentType := xevents.ContentTypeOf(res)
+		codec, err = xevents.DefaultCodecs().Get(contentType)
+		if err != nil {
+			return xrabbitmq.Payload{}, err
+		}
+
+		body, err := codec.Marshal(res)
+		if err != nil {
+			return xrabbitmq.Payload{}, fmt.Errorf("failed to marshal reply: %w", err)
+		}
+
+		return xrabbitmq.Payload{ContentType: contentType, Body: body}, nil
+	}, b.streamOptions(xevents.NewListenOptions(opts...))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start serving: %w", err)
+	}
+
+	return stream, nil
+}
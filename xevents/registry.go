@@ -0,0 +1,169 @@
+package xevents
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+func NewTopicRegistry() *TopicRegistry {
+	return &TopicRegistry{
+		types:     make(map[string]reflect.Type),
+		upcasters: make(map[string]map[int]Upcaster),
+	}
+}
+
+// TopicRegistry maps each topic to the Go type of its payload.
+//
+// It lets brokers and storages hand over events whose payload is already the concrete type,
+// and lets listeners detect at startup the topics nobody knows how to decode.
+type TopicRegistry struct {
+	mu        sync.RWMutex
+	types     map[string]reflect.Type
+	upcasters map[string]map[int]Upcaster
+}
+
+// Register associates the topics with the payload type P.
+//
+// When no topic is given, the topic returned by P's zero value is used.
+// Registering a topic that is already associated with another type is an error.
+func Register[P Payload](r *TopicRegistry, topics ...string) error {
+	typ := reflect.TypeFor[P]()
+
+	if len(topics) == 0 {
+		topics = []string{newPayload(typ).Topic()}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var retErr error
+	for _, topic := range topics {
+		existing, ok := r.types[topic]
+		if ok && existing != typ {
+			retErr = errors.Join(retErr, fmt.Errorf("topic %q is already registered with payload type %s, cannot register %s", topic, existing, typ))
+			continue
+		}
+		r.types[topic] = typ
+	}
+
+	return retErr
+}
+
+// MustRegister is like Register but panics on collisions, for registrations made at init time.
+func MustRegister[P Payload](r *TopicRegistry, topics ...string) {
+	if err := Register[P](r, topics...); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterTopic registers the payload type P on the default registry.
+func RegisterTopic[P Payload](topics ...string) error {
+	return Register[P](defaultTopics, topics...)
+}
+
+var defaultTopics = NewTopicRegistry()
+
+// DefaultTopicRegistry returns the registry used by brokers and storages unless told otherwise.
+func DefaultTopicRegistry() *TopicRegistry {
+	return defaultTopics
+}
+
+// IsEmpty tells whether no topic has been registered, in which case events are left undecoded.
+func (r *TopicRegistry) IsEmpty() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.types) == 0
+}
+
+// TypeOf returns the payload type registered for the topic.
+func (r *TopicRegistry) TypeOf(topic string) (reflect.Type, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	typ, ok := r.types[topic]
+	return typ, ok
+}
+
+// Check returns an error listing the topics that are not registered.
+func (r *TopicRegistry) Check(topics ...string) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var missing []string
+	for _, topic := range topics {
+		if _, ok := r.types[topic]; !ok {
+			missing = append(missing, topic)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	sort.Strings(missing)
+	return fmt.Errorf("no payload type registered for topics %q", missing)
+}
+
+// CheckPairs makes sure every handled topic is registered.
+//
+// An empty registry is considered unused and never fails the check.
+func (r *TopicRegistry) CheckPairs(pairs ...HandlerPair) error {
+	if r.IsEmpty() {
+		return nil
+	}
+
+	topics := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		topics = append(topics, pair.Topic)
+	}
+
+	return r.Check(topics...)
+}
+
+// Decode returns the event upcasted to the latest schema version of its topic,
+// with its payload decoded to the type registered for the topic.
+//
+// Events whose topic is not registered, or whose payload is already of the right type, are returned untouched.
+func (r *TopicRegistry) Decode(event *Event) (*Event, error) {
+	event, err := r.Upcast(event)
+	if err != nil {
+		return nil, err
+	}
+
+	typ, ok := r.TypeOf(event.Data().Topic)
+	if !ok {
+		return event, nil
+	}
+
+	if payload := event.Data().Payload; payload != nil && reflect.TypeOf(payload) == typ {
+		return event, nil
+	}
+
+	target := reflect.New(typ)
+	if err := event.UnmarshalPayload(target.Interface()); err != nil {
+		return nil, fmt.Errorf("failed to decode payload of topic %q to %s: %w", event.Data().Topic, typ, err)
+	}
+
+	payload, ok := target.Elem().Interface().(Payload)
+	if !ok || (typ.Kind() == reflect.Pointer && target.Elem().IsNil()) {
+		return nil, fmt.Errorf("decoded payload of topic %q is empty", event.Data().Topic)
+	}
+
+	if !payload.IsValid() {
+		return nil, fmt.Errorf("decoded payload of topic %q is invalid", event.Data().Topic)
+	}
+
+	decoded := *event
+	decoded.content.Payload = payload
+	return &decoded, nil
+}
+
+// newPayload returns a usable zero value of the payload type, allocating it if it's a pointer.
+func newPayload(typ reflect.Type) Payload {
+	if typ.Kind() == reflect.Pointer {
+		return reflect.New(typ.Elem()).Interface().(Payload)
+	}
+	return reflect.Zero(typ).Interface().(Payload)
+}
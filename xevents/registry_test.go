@@ -0,0 +1,73 @@
+package xevents_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xid"
+	"github.com/raphoester/x/xtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterReportsCollisions(t *testing.T) {
+	registry := xevents.NewTopicRegistry()
+
+	require.NoError(t, xevents.Register[xevents.ExamplePayload](registry))
+	require.NoError(t, xevents.Register[xevents.ExamplePayload](registry), "registering the same type twice is harmless")
+
+	err := xevents.Register[*xevents.ExamplePayload](registry, xevents.ExamplePayloadDefaultTopicName)
+	assert.Error(t, err)
+
+	typ, ok := registry.TypeOf(xevents.ExamplePayloadDefaultTopicName)
+	require.True(t, ok)
+	assert.Equal(t, "xevents.ExamplePayload", typ.String())
+}
+
+func TestCheckPairsReportsUnregisteredTopics(t *testing.T) {
+	registry := xevents.NewTopicRegistry()
+	pairs := []xevents.HandlerPair{{Topic: "registered"}, {Topic: "unregistered"}}
+
+	assert.NoError(t, registry.CheckPairs(pairs...), "an empty registry is not in use")
+
+	require.NoError(t, xevents.Register[xevents.ExamplePayload](registry, "registered"))
+	assert.ErrorContains(t, registry.CheckPairs(pairs...), "unregistered")
+}
+
+func TestDecode(t *testing.T) {
+	registry := xevents.NewTopicRegistry()
+	require.NoError(t, xevents.Register[*xevents.ExamplePayload](registry))
+
+	tests := []struct {
+		name    string
+		payload any
+	}{
+		{name: "raw bytes", payload: []byte(`{"key":"value"}`)},
+		{name: "generic map", payload: map[string]any{"key": "value"}},
+		{name: "other struct type", payload: xevents.ExamplePayload{Key: "value"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := xevents.Restore("id", xtime.NewDefaultFixedProvider().Now(), xevents.ExamplePayloadDefaultTopicName, tt.payload)
+
+			decoded, err := registry.Decode(event)
+			require.NoError(t, err)
+
+			payload, ok := decoded.Data().Payload.(*xevents.ExamplePayload)
+			require.True(t, ok, "payload is %T", decoded.Data().Payload)
+			assert.Equal(t, "value", payload.Key)
+		})
+	}
+}
+
+func TestDecodeLeavesUnregisteredTopicsUntouched(t *testing.T) {
+	event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.NewDefaultFixedGenerator(),
+		xevents.ExamplePayload{Key: "value"}.WithTopic("unregistered"))
+	require.NoError(t, err)
+
+	decoded, err := xevents.NewTopicRegistry().Decode(event)
+	require.NoError(t, err)
+	assert.Same(t, event, decoded)
+}
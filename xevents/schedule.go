@@ -0,0 +1,32 @@
+package xevents
+
+import (
+	"context"
+	"time"
+)
+
+// ScheduledPublisher is implemented by the publishers able to deliver events later.
+//
+// Publishing an event delayed with DelayedUntil through Publish schedules it as well.
+type ScheduledPublisher interface {
+	PublishAt(ctx context.Context, event *Event, at time.Time) error
+	PublishAfter(ctx context.Context, event *Event, delay time.Duration) error
+}
+
+// DelayedUntil returns a copy of the event that is not delivered before the given time.
+//
+// Outbox storages keep the event pending until then, and the brokers implementing ScheduledPublisher
+// schedule it when it is published.
+func (e *Event) DelayedUntil(at time.Time) *Event {
+	cp := *e
+	cp.content.Metadata = e.content.Metadata.Clone()
+	cp.content.DeliverAfter = at
+	return &cp
+}
+
+// WithDeliverAfter restores the time before which the event is not delivered.
+func WithDeliverAfter(at time.Time) RestoreOption {
+	return func(data *EventData) {
+		data.DeliverAfter = at
+	}
+}
@@ -3,8 +3,9 @@ package xevents
 type ExamplePayload struct {
 	Key string `json:"key"`
 
-	topicName string
-	isValid   *bool
+	topicName   string
+	isValid     *bool
+	orderingKey string
 }
 
 func (p ExamplePayload) Topic() string {
@@ -28,6 +29,15 @@ func (p ExamplePayload) WithIsValid(value bool) ExamplePayload {
 	}
 }
 
+func (p ExamplePayload) WithOrderingKey(key string) ExamplePayload {
+	p.orderingKey = key
+	return p
+}
+
+func (p ExamplePayload) OrderingKey() string {
+	return p.orderingKey
+}
+
 func (p ExamplePayload) IsValid() bool {
 	if p.isValid != nil {
 		return *p.isValid
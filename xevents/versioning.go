@@ -0,0 +1,133 @@
+package xevents
+
+import (
+	"fmt"
+	"maps"
+)
+
+// Versioned can be implemented by payloads whose shape changes over time.
+//
+// Payloads not implementing it are considered to be at version 1.
+type Versioned interface {
+	SchemaVersion() int
+}
+
+const initialSchemaVersion = 1
+
+func schemaVersionOf(p Payload) int {
+	if versioned, ok := p.(Versioned); ok && versioned.SchemaVersion() > 0 {
+		return versioned.SchemaVersion()
+	}
+	return initialSchemaVersion
+}
+
+// Upcaster transforms the generic form of a payload from one schema version to the next one.
+//
+// The document is the payload decoded by the codec of the event's content type to a map,
+// which is why upcasting is not available to formats such as protobuf that can't be decoded without a schema.
+type Upcaster func(doc map[string]any) (map[string]any, error)
+
+// RegisterUpcaster registers the function bringing payloads of the topic from fromVersion to fromVersion+1.
+func (r *TopicRegistry) RegisterUpcaster(topic string, fromVersion int, fn Upcaster) error {
+	if fromVersion < initialSchemaVersion {
+		return fmt.Errorf("invalid upcaster source version %d for topic %q", fromVersion, topic)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.upcasters[topic] == nil {
+		r.upcasters[topic] = make(map[int]Upcaster)
+	}
+
+	if _, ok := r.upcasters[topic][fromVersion]; ok {
+		return fmt.Errorf("an upcaster from version %d is already registered for topic %q", fromVersion, topic)
+	}
+
+	r.upcasters[topic][fromVersion] = fn
+	return nil
+}
+
+// RegisterUpcaster registers the upcaster on the default registry.
+func RegisterUpcaster(topic string, fromVersion int, fn Upcaster) error {
+	return defaultTopics.RegisterUpcaster(topic, fromVersion, fn)
+}
+
+// latestVersion is the version handlers expect for the topic:
+// the one of the registered payload type, or the last one reachable through the upcasters.
+func (r *TopicRegistry) latestVersion(topic string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	latest := initialSchemaVersion
+	if typ, ok := r.types[topic]; ok {
+		latest = schemaVersionOf(newPayload(typ))
+	}
+
+	for from := range r.upcasters[topic] {
+		if from+1 > latest {
+			latest = from + 1
+		}
+	}
+
+	return latest
+}
+
+func (r *TopicRegistry) upcaster(topic string, fromVersion int) (Upcaster, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fn, ok := r.upcasters[topic][fromVersion]
+	return fn, ok
+}
+
+// Upcast runs the chain of upcasters needed to bring the event's payload to the latest version of its topic.
+//
+// Events already at the latest version are returned untouched.
+func (r *TopicRegistry) Upcast(event *Event) (*Event, error) {
+	topic := event.Data().Topic
+	version := event.Data().SchemaVersion
+	if version < initialSchemaVersion {
+		version = initialSchemaVersion
+	}
+
+	target := r.latestVersion(topic)
+	if version >= target {
+		return event, nil
+	}
+
+	doc, err := event.document()
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain generic form of payload for upcasting: %w", err)
+	}
+
+	for ; version < target; version++ {
+		fn, ok := r.upcaster(topic, version)
+		if !ok {
+			return nil, fmt.Errorf("missing upcaster from version %d to %d for topic %q", version, version+1, topic)
+		}
+
+		doc, err = fn(doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upcast topic %q from version %d to %d: %w", topic, version, version+1, err)
+		}
+	}
+
+	upcasted := *event
+	upcasted.content.Payload = doc
+	upcasted.content.SchemaVersion = target
+	return &upcasted, nil
+}
+
+// document returns a copy of the payload under the form of a generic map.
+func (e *Event) document() (map[string]any, error) {
+	if doc, ok := e.content.Payload.(map[string]any); ok {
+		return maps.Clone(doc), nil
+	}
+
+	doc := make(map[string]any)
+	if err := e.UnmarshalPayload(&doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
@@ -0,0 +1,108 @@
+package xevents_test
+
+import (
+	"testing"
+
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type versionedPayload struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Country   string `json:"country"`
+}
+
+func (p versionedPayload) Topic() string      { return "user.created" }
+func (p versionedPayload) IsValid() bool      { return true }
+func (p versionedPayload) SchemaVersion() int { return 3 }
+
+func newVersionedRegistry(t *testing.T) *xevents.TopicRegistry {
+	registry := xevents.NewTopicRegistry()
+	require.NoError(t, xevents.Register[versionedPayload](registry))
+
+	// v1 had a single "name" field
+	require.NoError(t, registry.RegisterUpcaster("user.created", 1, func(doc map[string]any) (map[string]any, error) {
+		doc["first_name"] = doc["name"]
+		doc["last_name"] = ""
+		delete(doc, "name")
+		return doc, nil
+	}))
+
+	// v2 didn't have any country
+	require.NoError(t, registry.RegisterUpcaster("user.created", 2, func(doc map[string]any) (map[string]any, error) {
+		doc["country"] = "FR"
+		return doc, nil
+	}))
+
+	return registry
+}
+
+func TestDecodeRunsUpcasterChain(t *testing.T) {
+	registry := newVersionedRegistry(t)
+
+	tests := []struct {
+		name     string
+		version  int
+		payload  string
+		expected versionedPayload
+	}{
+		{
+			name:     "from v1",
+			version:  1,
+			payload:  `{"name":"john"}`,
+			expected: versionedPayload{FirstName: "john", Country: "FR"},
+		}, {
+			name:     "from v2",
+			version:  2,
+			payload:  `{"first_name":"john","last_name":"doe"}`,
+			expected: versionedPayload{FirstName: "john", LastName: "doe", Country: "FR"},
+		}, {
+			name:     "already latest",
+			version:  3,
+			payload:  `{"first_name":"john","last_name":"doe","country":"US"}`,
+			expected: versionedPayload{FirstName: "john", LastName: "doe", Country: "US"},
+		}, {
+			name:     "legacy events without version are v1",
+			version:  0,
+			payload:  `{"name":"john"}`,
+			expected: versionedPayload{FirstName: "john", Country: "FR"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := xevents.Restore("id", xtime.NewDefaultFixedProvider().Now(), "user.created", []byte(tt.payload),
+				xevents.WithSchemaVersion(tt.version),
+			)
+
+			decoded, err := registry.Decode(event)
+			require.NoError(t, err)
+
+			assert.Equal(t, 3, decoded.Data().SchemaVersion)
+			assert.Equal(t, tt.expected, decoded.Data().Payload)
+		})
+	}
+}
+
+func TestUpcastFailsOnMissingStep(t *testing.T) {
+	registry := xevents.NewTopicRegistry()
+	require.NoError(t, xevents.Register[versionedPayload](registry))
+	require.NoError(t, registry.RegisterUpcaster("user.created", 2, func(doc map[string]any) (map[string]any, error) {
+		return doc, nil
+	}))
+
+	event := xevents.Restore("id", xtime.NewDefaultFixedProvider().Now(), "user.created", []byte(`{}`))
+	_, err := registry.Upcast(event)
+	assert.ErrorContains(t, err, "missing upcaster from version 1 to 2")
+}
+
+func TestRegisterUpcasterRejectsDuplicates(t *testing.T) {
+	registry := newVersionedRegistry(t)
+	err := registry.RegisterUpcaster("user.created", 1, func(doc map[string]any) (map[string]any, error) {
+		return doc, nil
+	})
+	assert.Error(t, err)
+}
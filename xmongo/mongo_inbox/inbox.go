@@ -0,0 +1,204 @@
+package mongo_inbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/raphoester/x/xerrs"
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xmongo/mongo_helpers"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Config struct {
+	// Retention is how long processed event IDs are remembered. Duplicates arriving later are not detected.
+	// It is kept by a TTL index, to the second, so it must be at least a second.
+	Retention time.Duration `yaml:"retention"`
+
+	// Transactional makes the middleware open a transaction around handlers that are not already running in one,
+	// so that the handler's writes made through its context and the processed mark are committed together.
+	Transactional bool `yaml:"transactional"`
+}
+
+func (c *Config) ResetToDefault() {
+	c.Retention = 7 * 24 * time.Hour
+	c.Transactional = false
+}
+
+func New(client *mongo.Client, config Config) (*Inbox, error) {
+	// shorter retentions give a TTL index purging the records right away, which would disable deduplication
+	if config.Retention < time.Second {
+		return nil, fmt.Errorf("retention must be at least a second, got %s", config.Retention)
+	}
+
+	return &Inbox{
+		collection: obtainCollection(client),
+		config:     config,
+	}, nil
+}
+
+func NewFromDB(db *mongo.Database, config Config) (*Inbox, error) {
+	return New(db.Client(), config)
+}
+
+// Inbox records the events processed by each consumer, to make handlers idempotent.
+type Inbox struct {
+	collection *mongo.Collection
+	config     Config
+}
+
+// this is not ideal because the database/collection names should be configurable
+
+const inboxCollectionName = "ProcessedEvents"
+const inboxDatabaseName = "Inbox"
+
+func obtainCollection(client *mongo.Client) *mongo.Collection {
+	return client.Database(inboxDatabaseName).Collection(inboxCollectionName)
+}
+
+type processedEventDAO struct {
+	ID          string    `bson:"_id"`
+	Consumer    string    `bson:"consumer"`
+	EventID     string    `bson:"event_id"`
+	Topic       string    `bson:"topic"`
+	ProcessedAt time.Time `bson:"processed_at"`
+}
+
+func processedEventID(consumer string, eventID string) string {
+	return consumer + "/" + eventID
+}
+
+// EnsureIndexes creates the TTL index removing processed event IDs once the retention is over.
+func (i *Inbox) EnsureIndexes(ctx context.Context) error {
+	_, err := i.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "processed_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(i.config.Retention.Seconds())),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create ttl index: %w", err)
+	}
+
+	return nil
+}
+
+// Cleanup removes the processed event IDs recorded before the given time, for deployments not relying on the TTL index.
+func (i *Inbox) Cleanup(ctx context.Context, before time.Time) (int64, error) {
+	res, err := i.collection.DeleteMany(ctx, bson.M{"processed_at": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete processed events: %w", err)
+	}
+
+	return res.DeletedCount, nil
+}
+
+// IsProcessed tells whether the consumer already processed the event.
+func (i *Inbox) IsProcessed(ctx context.Context, consumer string, eventID string) (bool, error) {
+	err := i.collection.FindOne(ctx, bson.M{"_id": processedEventID(consumer, eventID)}).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("failed to find processed event: %w", err)
+	}
+
+	return true, nil
+}
+
+// MarkAsProcessed records that the consumer processed the event.
+//
+// It fails with xerrs.ErrConflict if the event was already recorded for the consumer.
+func (i *Inbox) MarkAsProcessed(ctx context.Context, consumer string, event *xevents.Event) error {
+	_, err := i.collection.InsertOne(ctx, processedEventDAO{
+		ID:          processedEventID(consumer, event.Data().ID),
+		Consumer:    consumer,
+		EventID:     event.Data().ID,
+		Topic:       event.Data().Topic,
+		ProcessedAt: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark event as processed: %w", mongo_helpers.MapErr(err))
+	}
+
+	return nil
+}
+
+// Middleware skips the events the consumer already processed and records the ones it processes successfully.
+//
+// When the handler runs inside a Mongo transaction (the context is a session context with a running transaction),
+// the processed mark is written in that transaction, so that it is rolled back along with the handler's writes.
+// Otherwise the event is marked once the handler succeeded, which leaves a small window for duplicates
+// if marking fails, unless the inbox is configured to open its own transactions.
+func (i *Inbox) Middleware(consumer string) xevents.Middleware {
+	return func(next xevents.Handler) xevents.Handler {
+		return func(ctx context.Context, event *xevents.Event) error {
+			if inTransaction(ctx) {
+				return i.handleOnce(ctx, consumer, event, next)
+			}
+
+			if i.config.Transactional {
+				session, err := i.collection.Database().Client().StartSession()
+				if err != nil {
+					return fmt.Errorf("failed to start session for transaction: %w", err)
+				}
+				defer session.EndSession(context.Background())
+
+				_, err = session.WithTransaction(ctx, func(ctx mongo.SessionContext) (interface{}, error) {
+					return nil, i.handleOnce(ctx, consumer, event, next)
+				})
+				return err
+			}
+
+			processed, err := i.IsProcessed(ctx, consumer, event.Data().ID)
+			if err != nil {
+				return err
+			}
+
+			if processed {
+				return nil
+			}
+
+			if err := next(ctx, event); err != nil {
+				return err
+			}
+
+			// a conflict means a concurrent delivery of the same event has been processed in the meantime
+			if err := i.MarkAsProcessed(ctx, consumer, event); err != nil && !errors.Is(err, xerrs.ErrConflict) {
+				return err
+			}
+
+			return nil
+		}
+	}
+}
+
+// handleOnce marks the event as processed then runs the handler, both in the context's transaction.
+func (i *Inbox) handleOnce(ctx context.Context, consumer string, event *xevents.Event, next xevents.Handler) error {
+	processed, err := i.IsProcessed(ctx, consumer, event.Data().ID)
+	if err != nil {
+		return err
+	}
+
+	if processed {
+		return nil
+	}
+
+	if err := i.MarkAsProcessed(ctx, consumer, event); err != nil {
+		return err
+	}
+
+	return next(ctx, event)
+}
+
+func inTransaction(ctx context.Context) bool {
+	session, ok := mongo.SessionFromContext(ctx).(mongo.XSession)
+	if !ok {
+		return false
+	}
+
+	return session.ClientSession().TransactionRunning()
+}
@@ -0,0 +1,166 @@
+package mongo_inbox_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/raphoester/x/xdockertest"
+	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xid"
+	"github.com/raphoester/x/xmongo/mongo_inbox"
+	"github.com/raphoester/x/xtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestRunSuite(t *testing.T) {
+	suite.Run(t, new(testSuite))
+}
+
+type testSuite struct {
+	suite.Suite
+	mongo *xdockertest.Mongo
+}
+
+func (s *testSuite) SetupSuite() {
+	db, err := xdockertest.NewMongo()
+	s.Require().NoError(err)
+	s.mongo = db
+}
+
+func (s *testSuite) TearDownSuite() {
+	_ = s.mongo.Destroy()
+}
+
+func (s *testSuite) SetupTest() {
+	err := s.mongo.Clean()
+	if err != nil {
+		s.T().Log("failed to clean database:", err)
+	}
+}
+
+func (s *testSuite) newInbox(transactional bool) *mongo_inbox.Inbox {
+	config := mongo_inbox.Config{}
+	config.ResetToDefault()
+	config.Transactional = transactional
+	inbox, err := mongo_inbox.New(s.mongo.Client, config)
+	s.Require().NoError(err)
+	s.Require().NoError(inbox.EnsureIndexes(context.Background()))
+	return inbox
+}
+
+func TestRetentionMustBeAtLeastASecond(t *testing.T) {
+	for _, retention := range []time.Duration{0, 500 * time.Millisecond} {
+		_, err := mongo_inbox.New(nil, mongo_inbox.Config{Retention: retention})
+		assert.Error(t, err)
+	}
+}
+
+func (s *testSuite) newEvent() *xevents.Event {
+	event, err := xevents.New(
+		context.Background(),
+		xtime.NewDefaultFixedProvider(),
+		xid.RandomGenerator{},
+		xevents.ExamplePayload{Key: "value"},
+	)
+	s.Require().NoError(err)
+	return event
+}
+
+func (s *testSuite) TestSkipsDuplicates() {
+	for _, transactional := range []bool{false, true} {
+		inbox := s.newInbox(transactional)
+
+		calls := 0
+		handler := xevents.Chain(func(ctx context.Context, event *xevents.Event) error {
+			calls++
+			return nil
+		}, inbox.Middleware("consumer"))
+
+		event := s.newEvent()
+		s.Require().NoError(handler(context.Background(), event))
+		s.Require().NoError(handler(context.Background(), event))
+		s.Assert().Equal(1, calls)
+
+		// another consumer processes the event on its own
+		otherHandler := xevents.Chain(func(ctx context.Context, event *xevents.Event) error {
+			calls++
+			return nil
+		}, inbox.Middleware("other_consumer"))
+		s.Require().NoError(otherHandler(context.Background(), event))
+		s.Assert().Equal(2, calls)
+	}
+}
+
+func (s *testSuite) TestFailedHandlerIsNotMarked() {
+	inbox := s.newInbox(false)
+
+	fail := true
+	calls := 0
+	handler := xevents.Chain(func(ctx context.Context, event *xevents.Event) error {
+		calls++
+		if fail {
+			return errors.New("failure")
+		}
+		return nil
+	}, inbox.Middleware("consumer"))
+
+	event := s.newEvent()
+	s.Require().Error(handler(context.Background(), event))
+
+	fail = false
+	s.Require().NoError(handler(context.Background(), event))
+	s.Assert().Equal(2, calls)
+}
+
+func (s *testSuite) TestMarkIsRolledBackWithHandlerTransaction() {
+	inbox := s.newInbox(true)
+	collection := s.mongo.Client.Database("inbox_test").Collection("projections")
+
+	fail := true
+	handler := xevents.Chain(func(ctx context.Context, event *xevents.Event) error {
+		if _, err := collection.InsertOne(ctx, bson.M{"_id": event.Data().ID}); err != nil {
+			return err
+		}
+		if fail {
+			return errors.New("failure")
+		}
+		return nil
+	}, inbox.Middleware("consumer"))
+
+	event := s.newEvent()
+	s.Require().Error(handler(context.Background(), event))
+
+	processed, err := inbox.IsProcessed(context.Background(), "consumer", event.Data().ID)
+	s.Require().NoError(err)
+	s.Assert().False(processed)
+
+	err = collection.FindOne(context.Background(), bson.M{"_id": event.Data().ID}).Err()
+	s.Assert().ErrorIs(err, mongo.ErrNoDocuments)
+
+	fail = false
+	s.Require().NoError(handler(context.Background(), event))
+
+	processed, err = inbox.IsProcessed(context.Background(), "consumer", event.Data().ID)
+	s.Require().NoError(err)
+	s.Assert().True(processed)
+}
+
+func (s *testSuite) TestCleanup() {
+	inbox := s.newInbox(false)
+
+	event := s.newEvent()
+	s.Require().NoError(inbox.MarkAsProcessed(context.Background(), "consumer", event))
+
+	deleted, err := inbox.Cleanup(context.Background(), time.Now().Add(time.Minute))
+	s.Require().NoError(err)
+	s.Assert().EqualValues(1, deleted)
+
+	processed, err := inbox.IsProcessed(context.Background(), "consumer", event.Data().ID)
+	s.Require().NoError(err)
+	s.Assert().False(processed)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"testing"
+	"time"
 
 	"github.com/raphoester/chaos"
 	"github.com/raphoester/x/xdockertest"
@@ -94,6 +95,7 @@ func (s *testSuite) TestSaveAggregateWithEvents() {
 	}
 
 	event, err := xevents.New(
+		context.Background(),
 		xtime.NewDefaultFixedProvider(),
 		xid.NewDefaultFixedGenerator(),
 		&xevents.ExamplePayload{Key: "value"},
@@ -191,6 +193,7 @@ func (s *testSuite) TestSaveEventsOnUnmodifiedAggregate() {
 	// add events without modifying the aggregate
 
 	event, err := xevents.New(
+		context.Background(),
 		xtime.NewDefaultFixedProvider(),
 		xid.NewDefaultFixedGenerator(),
 		&xevents.ExamplePayload{Key: "value"},
@@ -245,6 +248,7 @@ func (s *testSuite) TestErrorOnVersionConflict() {
 		Version:   xver.Restore(storedVersion),
 	}
 	passingEvent, err := xevents.New(
+		context.Background(),
 		xtime.NewDefaultFixedProvider(),
 		xid.NewDefaultFixedGenerator(),
 		&xevents.ExamplePayload{Key: wantedPayloadKey},
@@ -260,6 +264,7 @@ func (s *testSuite) TestErrorOnVersionConflict() {
 		Version:   xver.Restore(storedVersion),
 	}
 	failingEvent, err := xevents.New(
+		context.Background(),
 		xtime.NewDefaultFixedProvider(),
 		xid.NewDefaultFixedGenerator(),
 		&xevents.ExamplePayload{Key: "value2"},
@@ -340,6 +345,7 @@ func (s *testSuite) TestEventsNotSavedOnUnmodifiedConflictingAggregate() {
 	passingPayloadValue := "value1"
 	eventIDGenerator := xid.NewChaoticGenerator(s.chaos)
 	passingEvent, err := xevents.New(
+		context.Background(),
 		xtime.NewDefaultFixedProvider(),
 		eventIDGenerator,
 		&xevents.ExamplePayload{Key: passingPayloadValue},
@@ -355,6 +361,7 @@ func (s *testSuite) TestEventsNotSavedOnUnmodifiedConflictingAggregate() {
 	}
 	// don't record a new modification to check if even then the conflict is detected
 	failingEvent, err := xevents.New(
+		context.Background(),
 		xtime.NewDefaultFixedProvider(),
 		eventIDGenerator,
 		&xevents.ExamplePayload{Key: "value2"},
@@ -390,3 +397,72 @@ func (s *testSuite) TestEventsNotSavedOnUnmodifiedConflictingAggregate() {
 	s.Require().NoError(err)
 	s.Assert().Equal(passingPayloadValue, payload.Key)
 }
+
+func (s *testSuite) TestMarkAllAsPublished() {
+	storage := mongo_outbox.NewStorage(s.mongo.Client)
+
+	events := make([]*xevents.Event, 0, 3)
+	for range 3 {
+		event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: "value"})
+		s.Require().NoError(err)
+		events = append(events, event)
+	}
+	s.Require().NoError(storage.Save(context.Background(), events...))
+
+	err := storage.MarkAllAsPublished(context.Background(), events[0].Data().ID, events[2].Data().ID)
+	s.Require().NoError(err)
+
+	pending, err := storage.GetPending(context.Background())
+	s.Require().NoError(err)
+	s.Require().Len(pending, 1)
+	s.Assert().Equal(events[1].Data().ID, pending[0].Data().ID)
+}
+
+func (s *testSuite) TestGetPendingRespectsDeliverAfter() {
+	storage := mongo_outbox.NewStorage(s.mongo.Client)
+
+	newEvent := func() *xevents.Event {
+		event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: "value"})
+		s.Require().NoError(err)
+		return event
+	}
+
+	due := newEvent().DelayedUntil(time.Now().Add(-time.Minute))
+	later := newEvent().DelayedUntil(time.Now().Add(time.Hour))
+	immediate := newEvent()
+	s.Require().NoError(storage.Save(context.Background(), due, later, immediate))
+
+	pending, err := storage.GetPending(context.Background())
+	s.Require().NoError(err)
+
+	ids := make([]string, 0, len(pending))
+	for _, event := range pending {
+		ids = append(ids, event.Data().ID)
+	}
+	s.Assert().ElementsMatch([]string{due.Data().ID, immediate.Data().ID}, ids)
+}
+
+func (s *testSuite) TestGetPendingSkipsEventsThatCantBeRestored() {
+	registry := xevents.NewTopicRegistry()
+	s.Require().NoError(xevents.Register[xevents.ExamplePayload](registry, "topic.outbox"))
+	storage := mongo_outbox.NewStorage(s.mongo.Client, mongo_outbox.WithTopicRegistry(registry))
+
+	event, err := xevents.New(context.Background(), xtime.NewDefaultFixedProvider(), xid.RandomGenerator{}, xevents.ExamplePayload{Key: "value"}.WithTopic("topic.outbox"))
+	s.Require().NoError(err)
+	s.Require().NoError(storage.Save(context.Background(), event))
+
+	_, err = s.mongo.Client.Database("Outbox").Collection("Events").InsertOne(context.Background(), mongo_outbox.EventDAO{
+		ID:             "corrupt",
+		CreatedAt:      time.Now(),
+		Topic:          "topic.outbox",
+		ContentType:    "application/unknown",
+		EncodedPayload: []byte("garbage"),
+	})
+	s.Require().NoError(err)
+
+	pending, err := storage.GetPending(context.Background())
+	s.Require().NoError(err)
+	s.Require().Len(pending, 1)
+	s.Assert().Equal(event.Data().ID, pending[0].Data().ID)
+	s.Assert().IsType(xevents.ExamplePayload{}, pending[0].Data().Payload, "decoded with the given registry")
+}
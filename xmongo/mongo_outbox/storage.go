@@ -8,32 +8,68 @@ import (
 
 	"github.com/raphoester/x/xerrs"
 	"github.com/raphoester/x/xevents"
+	"github.com/raphoester/x/xlog"
+	"github.com/raphoester/x/xlog/lf"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func NewStorage(client *mongo.Client) *Storage {
-	return &Storage{
+func NewStorage(client *mongo.Client, opts ...StorageOption) *Storage {
+	s := &Storage{
 		collection: obtainCollection(client),
+		registry:   xevents.DefaultTopicRegistry(),
+		logger:     xlog.NopLogger{},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func NewStorageFromDB(db *mongo.Database, opts ...StorageOption) *Storage {
+	return NewStorage(db.Client(), opts...)
+}
+
+type StorageOption func(*Storage)
+
+// WithTopicRegistry replaces the default registry used to decode the payloads of the stored events.
+func WithTopicRegistry(registry *xevents.TopicRegistry) StorageOption {
+	return func(s *Storage) {
+		s.registry = registry
 	}
 }
 
-func NewStorageFromDB(db *mongo.Database) *Storage {
-	return &Storage{collection: obtainCollection(db.Client())}
+// WithLogger reports the stored events that are skipped because they can't be restored.
+func WithLogger(logger xlog.Logger) StorageOption {
+	return func(s *Storage) {
+		s.logger = logger
+	}
 }
 
 type Storage struct {
 	collection *mongo.Collection
+	registry   *xevents.TopicRegistry
+	logger     xlog.Logger
 }
 
+// GetPending returns the events that are not published yet.
+//
+// The events that can't be restored, like the ones whose payload can't be decoded, are logged and skipped
+// so that they don't block the others. They stay pending until fixed or removed.
 func (s *Storage) GetPending(ctx context.Context) ([]*xevents.Event, error) {
-	return findAllEvents(ctx, s.collection)
+	return findAllEvents(ctx, s.collection, s.registry, s.logger)
 }
 
 func (s *Storage) MarkAsPublished(ctx context.Context, id string) error {
 	return markAsPublished(ctx, s.collection, id)
 }
 
+func (s *Storage) MarkAllAsPublished(ctx context.Context, ids ...string) error {
+	return markAllAsPublished(ctx, s.collection, ids)
+}
+
 func (s *Storage) Save(ctx context.Context, events ...*xevents.Event) error {
 	return saveEvents(ctx, s.collection, events)
 }
@@ -69,6 +105,23 @@ func markAsPublished(ctx context.Context, collection *mongo.Collection, id strin
 	return nil
 }
 
+func markAllAsPublished(ctx context.Context, collection *mongo.Collection, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if _, err := collection.UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": ids}},
+		bson.M{
+			"$set": bson.M{"published_at": time.Now()},
+		},
+	); err != nil {
+		return fmt.Errorf("failed to mark %d events as published: %w", len(ids), err)
+	}
+
+	return nil
+}
+
 func SaveEvents(ctx context.Context, db *mongo.Database, events []*xevents.Event) error {
 	return saveEvents(ctx, obtainCollection(db.Client()), events)
 }
@@ -90,27 +143,56 @@ func saveEvents(ctx context.Context, collection *mongo.Collection, events []*xev
 	return nil
 }
 
-func FindAllEvents(ctx context.Context, db *mongo.Database) ([]*xevents.Event, error) {
-	return findAllEvents(ctx, obtainCollection(db.Client()))
+// FindAllEvents returns the pending events, see Storage.GetPending.
+func FindAllEvents(ctx context.Context, db *mongo.Database, opts ...StorageOption) ([]*xevents.Event, error) {
+	return NewStorageFromDB(db, opts...).GetPending(ctx)
 }
 
-func findAllEvents(ctx context.Context, collection *mongo.Collection) ([]*xevents.Event, error) {
+func findAllEvents(
+	ctx context.Context,
+	collection *mongo.Collection,
+	registry *xevents.TopicRegistry,
+	logger xlog.Logger,
+) ([]*xevents.Event, error) {
 
+	// delayed events stay pending until their time has come
 	cursor, err := collection.Find(ctx, bson.M{
 		"published_at": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"deliver_after": bson.M{"$exists": false}},
+			bson.M{"deliver_after": bson.M{"$lte": time.Now()}},
+		},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to find all events: %w", err)
 	}
 
-	var daos []*EventDAO
-	if err := cursor.All(ctx, &daos); err != nil {
-		return nil, fmt.Errorf("failed to decode all events: %w", err)
+	defer func() { _ = cursor.Close(ctx) }()
+
+	events := make([]*xevents.Event, 0)
+	for cursor.Next(ctx) {
+		dao := &EventDAO{}
+		if err := cursor.Decode(dao); err != nil {
+			id, _ := cursor.Current.Lookup("_id").StringValueOK()
+			logger.Error("skipping outbox event that can't be decoded", lf.String("event_id", id), lf.Err(err))
+			continue
+		}
+
+		event, err := daoToEvent(dao, registry)
+		if err != nil {
+			logger.Error("skipping outbox event that can't be restored",
+				lf.String("event_id", dao.ID),
+				lf.String("topic", dao.Topic),
+				lf.Err(err),
+			)
+			continue
+		}
+
+		events = append(events, event)
 	}
 
-	events, err := DAOsToEvents(daos)
-	if err != nil {
-		return nil, fmt.Errorf("failed to convert daos to events: %w", err)
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate over events: %w", err)
 	}
 
 	return events, nil
@@ -141,27 +223,51 @@ func getEventByID(ctx context.Context, collection *mongo.Collection, id string)
 	return event, nil
 }
 
+// EventDAO is the stored form of an event.
+//
+// JSON payloads are stored as documents to keep them readable and queryable,
+// payloads of any other content type are stored as encoded by their codec in EncodedPayload.
 type EventDAO struct {
-	ID        string `bson:"_id"`
-	CreatedAt time.Time
-	Topic     string
-	Payload   payloadMap
+	ID             string `bson:"_id"`
+	CreatedAt      time.Time
+	Topic          string
+	Payload        payloadMap
+	EncodedPayload []byte            `bson:"encoded_payload,omitempty"`
+	ContentType    string            `bson:"content_type"`
+	SchemaVersion  int               `bson:"schema_version"`
+	Metadata       map[string]string `bson:"metadata"`
+	DeliverAfter   time.Time         `bson:"deliver_after,omitempty"`
 }
 
 func EventToDAO(event *xevents.Event) (*EventDAO, error) {
 	eventData := event.Data()
-	payload := payloadMap{}
 
+	dao := &EventDAO{
+		ID:            eventData.ID,
+		CreatedAt:     eventData.CreatedAt,
+		Topic:         eventData.Topic,
+		ContentType:   eventData.ContentType,
+		SchemaVersion: eventData.SchemaVersion,
+		Metadata:      eventData.Metadata,
+		DeliverAfter:  eventData.DeliverAfter,
+	}
+
+	if !xevents.IsJSON(eventData.ContentType) {
+		encoded, err := event.MarshalPayload()
+		if err != nil {
+			return nil, err
+		}
+		dao.EncodedPayload = encoded
+		return dao, nil
+	}
+
+	payload := payloadMap{}
 	if err := event.UnmarshalPayload(&payload); err != nil {
 		return nil, err
 	}
+	dao.Payload = payload
 
-	return &EventDAO{
-		ID:        eventData.ID,
-		CreatedAt: eventData.CreatedAt,
-		Topic:     eventData.Topic,
-		Payload:   payload,
-	}, nil
+	return dao, nil
 }
 
 type payloadMap map[string]any
@@ -182,11 +288,28 @@ func EventsToDAOs(events []*xevents.Event) ([]any, error) {
 	return eventDAOs, nil
 }
 
+// DAOToEvent restores the event, decoding its payload with the default topic registry.
 func DAOToEvent(dao *EventDAO) (*xevents.Event, error) {
+	return daoToEvent(dao, xevents.DefaultTopicRegistry())
+}
+
+func daoToEvent(dao *EventDAO, registry *xevents.TopicRegistry) (*xevents.Event, error) {
 	if dao.ID == "" {
 		return nil, fmt.Errorf("id is empty")
 	}
 
+	opts := []xevents.RestoreOption{
+		xevents.WithContentType(dao.ContentType),
+		xevents.WithSchemaVersion(dao.SchemaVersion),
+		xevents.WithMetadata(dao.Metadata),
+		xevents.WithDeliverAfter(dao.DeliverAfter),
+	}
+
+	if !xevents.IsJSON(dao.ContentType) {
+		restored := xevents.Restore(dao.ID, dao.CreatedAt, dao.Topic, dao.EncodedPayload, opts...)
+		return registry.Decode(restored)
+	}
+
 	payload := make(map[string]any)
 	jsonBytes, err := dao.Payload.marshalJSON()
 	if err != nil {
@@ -197,8 +320,8 @@ func DAOToEvent(dao *EventDAO) (*xevents.Event, error) {
 		return nil, fmt.Errorf("failed to unmarshal payload: %w", err)
 	}
 
-	restored := xevents.Restore(dao.ID, dao.CreatedAt, dao.Topic, payload)
-	return restored, nil
+	restored := xevents.Restore(dao.ID, dao.CreatedAt, dao.Topic, payload, opts...)
+	return registry.Decode(restored)
 }
 
 func DAOsToEvents(daos []*EventDAO) ([]*xevents.Event, error) {
@@ -1,6 +1,7 @@
 package mongo_outbox_test
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 	"time"
@@ -11,13 +12,16 @@ import (
 	"github.com/raphoester/x/xtime"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 // TestEventConversion makes sure that the event is not altered when converting it to a DAO and back
 func TestEventConversion(t *testing.T) {
 	timeProvider := xtime.CustomProvider{NowFunc: func() time.Time { return time.Date(2024, time.October, 10, 0, 0, 0, 0, time.UTC) }}
 	idGenerator := xid.CustomGenerator{GenFunc: func() string { return "id" }}
+	ctx := xevents.WithTenant(context.Background(), "tenant")
 	event, err := xevents.New(
+		ctx,
 		timeProvider,
 		idGenerator,
 		&TestPayload{
@@ -41,6 +45,13 @@ func TestEventConversion(t *testing.T) {
 	require.Equal(t, event.Data().Topic, event2.Data().Topic)
 	require.Equal(t, event.Data().ID, event2.Data().ID)
 	require.Equal(t, event.Data().CreatedAt, event2.Data().CreatedAt)
+	require.Equal(t, event.Data().Metadata, event2.Data().Metadata)
+	require.Equal(t, "tenant", event2.Data().Metadata.Tenant())
+	require.True(t, event2.Data().DeliverAfter.IsZero())
+
+	delayed, err := mongo_outbox.DAOToEvent(mustDAO(t, event.DelayedUntil(timeProvider.Now().Add(time.Hour))))
+	require.NoError(t, err)
+	require.Equal(t, timeProvider.Now().Add(time.Hour), delayed.Data().DeliverAfter)
 
 	payload2, err := json.Marshal(event.Data().Payload)
 	require.NoError(t, err)
@@ -63,3 +74,27 @@ func (p *TestPayload) Topic() string {
 func (p *TestPayload) IsValid() bool {
 	return true
 }
+
+func mustDAO(t *testing.T, event *xevents.Event) *mongo_outbox.EventDAO {
+	dao, err := mongo_outbox.EventToDAO(event)
+	require.NoError(t, err)
+	return dao
+}
+
+func TestEventDAOFieldNames(t *testing.T) {
+	raw, err := bson.Marshal(mongo_outbox.EventDAO{
+		ID:             "id",
+		EncodedPayload: []byte("payload"),
+		ContentType:    "application/protobuf",
+		SchemaVersion:  2,
+		Metadata:       map[string]string{"key": "value"},
+		DeliverAfter:   time.Date(2024, time.October, 10, 0, 0, 0, 0, time.UTC),
+	})
+	require.NoError(t, err)
+
+	document := bson.M{}
+	require.NoError(t, bson.Unmarshal(raw, &document))
+	for _, key := range []string{"encoded_payload", "content_type", "schema_version", "metadata", "deliver_after"} {
+		assert.Contains(t, document, key)
+	}
+}
@@ -0,0 +1,169 @@
+package xrabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// BatchError tells which messages of a batch failed to be published.
+// Errors is aligned with the published payloads, a nil error meaning that the message was confirmed.
+type BatchError struct {
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	failed := e.Unwrap()
+	if len(failed) == 0 {
+		return "no message of the batch failed"
+	}
+	return fmt.Sprintf("failed to publish %d/%d messages of the batch: %s", len(failed), len(e.Errors), failed[0])
+}
+
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// PublishBatch publishes the payloads one after the other on a channel in confirm mode,
+// then waits for the broker to confirm them all.
+//
+// Whatever the configuration, it only returns once the broker took responsibility for the messages.
+// If some of them could not be published, the returned error is a *BatchError.
+func (c *Client) PublishBatch(ctx context.Context, payloads ...Payload) error {
+	return c.publishBatch(ctx, c.exchange, payloads...)
+}
+
+func (c *Client) publishBatch(ctx context.Context, exchange string, payloads ...Payload) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	if c.confirmers.mandatory {
+		if err := checkMessageIDs(payloads); err != nil {
+			return err
+		}
+	}
+
+	pc, err := c.confirmers.acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0, len(payloads))
+	for chunk := range slices.Chunk(payloads, returnsBufferSize) {
+		chunkErrs, broken := c.publishConfirmed(ctx, pc, exchange, chunk)
+		errs = append(errs, chunkErrs...)
+		if broken != nil {
+			// nothing can be published on the channel anymore
+			for range len(payloads) - len(errs) {
+				errs = append(errs, broken)
+			}
+			c.confirmers.release(pc, true)
+			pc = nil
+			break
+		}
+	}
+
+	if pc != nil {
+		c.confirmers.release(pc, false)
+	}
+
+	batchErr := &BatchError{Errors: errs}
+	if len(batchErr.Unwrap()) > 0 {
+		return batchErr
+	}
+
+	return nil
+}
+
+// ErrUnroutable is returned when publishing a mandatory message that no queue is bound to.
+var ErrUnroutable = errors.New("message could not be routed to any queue")
+
+// ErrMessageIDRequired is returned when publishing mandatory messages without an ID, or with the same ID
+// in a batch: the messages returned by the broker are told apart by their ID.
+var ErrMessageIDRequired = errors.New("mandatory messages need a unique message id")
+
+func checkMessageIDs(payloads []Payload) error {
+	ids := make(map[string]bool, len(payloads))
+	for _, payload := range payloads {
+		if payload.MessageID == "" {
+			return fmt.Errorf("%w: message on topic %q has none", ErrMessageIDRequired, payload.Topic)
+		}
+		if ids[payload.MessageID] {
+			return fmt.Errorf("%w: %q is used twice in the batch", ErrMessageIDRequired, payload.MessageID)
+		}
+		ids[payload.MessageID] = true
+	}
+	return nil
+}
+
+// returnsBufferSize bounds the number of messages published before waiting for their confirmations:
+// returned messages must not fill the buffer before being read, or the connection would block.
+const returnsBufferSize = 1024
+
+// publishConfirmed publishes the payloads on the channel and waits for their confirmations.
+//
+// It returns the error of each payload, and the error that made the channel unusable if any: once a message
+// can't be published, or its confirmation waited for, later returns could be mistaken for the next messages'.
+func (c *Client) publishConfirmed(ctx context.Context, pc *publishChannel, exchange string, payloads []Payload) ([]error, error) {
+	var broken error
+	errs := make([]error, len(payloads))
+	confirmations := make([]*amqp091.DeferredConfirmation, len(payloads))
+	for i, payload := range payloads {
+		confirmation, err := pc.ch.PublishWithDeferredConfirmWithContext(ctx,
+			exchange,
+			payload.Topic,
+			c.confirmers.mandatory,
+			false,
+			payload.publishing(),
+		)
+		if err != nil {
+			// the channel can't be trusted anymore, the rest of the batch is failed as well
+			broken = fmt.Errorf("failed to publish message: %w", err)
+			for j := i; j < len(payloads); j++ {
+				errs[j] = broken
+			}
+			break
+		}
+		confirmations[i] = confirmation
+	}
+
+	for i, confirmation := range confirmations {
+		if confirmation == nil {
+			continue
+		}
+
+		acked, err := confirmation.WaitContext(ctx)
+		if err != nil {
+			errs[i] = fmt.Errorf("failed to wait for confirmation: %w", err)
+			broken = errs[i]
+			continue
+		}
+
+		if !acked {
+			errs[i] = errors.New("message was not confirmed by the broker")
+			continue
+		}
+
+		// the broker returns an unroutable message before confirming it
+		if returned, ok := pc.takeReturn(payloads[i].MessageID); ok {
+			errs[i] = fmt.Errorf("%w: %s", ErrUnroutable, returned.ReplyText)
+		}
+	}
+
+	if broken == nil {
+		// every message of the batch was confirmed, so its returns were all received
+		pc.clearReturns()
+	}
+
+	return errs, broken
+}
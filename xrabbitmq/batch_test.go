@@ -0,0 +1,13 @@
+package xrabbitmq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckMessageIDs(t *testing.T) {
+	assert.NoError(t, checkMessageIDs([]Payload{{MessageID: "1"}, {MessageID: "2"}}))
+	assert.ErrorIs(t, checkMessageIDs([]Payload{{MessageID: "1"}, {}}), ErrMessageIDRequired)
+	assert.ErrorIs(t, checkMessageIDs([]Payload{{MessageID: "1"}, {MessageID: "1"}}), ErrMessageIDRequired)
+}
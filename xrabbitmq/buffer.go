@@ -0,0 +1,451 @@
+package xrabbitmq
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/raphoester/x/xlog"
+	"github.com/raphoester/x/xlog/lf"
+)
+
+type OverflowPolicy string
+
+const (
+	// OverflowBlock makes Publish wait for room in the buffer, until its context is done.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropOldest discards the oldest buffered message to make room for the new one.
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowError makes Publish fail with ErrBufferFull.
+	OverflowError OverflowPolicy = "error"
+)
+
+// PublishBufferConfig configures the buffer holding the messages published while RabbitMQ can't be reached.
+//
+// Buffered messages are published in order once the connection is back. Publish returns as soon as
+// the message is buffered, so messages buffered in memory are lost if the process stops before flushing them.
+type PublishBufferConfig struct {
+	Enabled  bool           `yaml:"enabled"`
+	Capacity int            `yaml:"capacity"`
+	Overflow OverflowPolicy `yaml:"overflow"`
+
+	// Directory stores the buffered messages on disk instead of memory, they are flushed after a restart as well.
+	Directory string `yaml:"directory"`
+
+	// FlushInterval is the delay between two attempts at flushing the buffer while RabbitMQ is unreachable.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+func (c *PublishBufferConfig) ResetToDefault() {
+	c.Enabled = false
+	c.Capacity = 10000
+	c.Overflow = OverflowBlock
+	c.Directory = ""
+	c.FlushInterval = time.Second
+}
+
+var ErrBufferFull = errors.New("publish buffer is full")
+
+// isConnectionError tells whether the error comes from RabbitMQ being unreachable.
+func isConnectionError(err error) bool {
+	return errors.Is(err, ErrConnectionClosed) || errors.Is(err, amqp091.ErrClosed)
+}
+
+// BufferStats describe the activity of the publish buffer since the client was created.
+type BufferStats struct {
+	// Buffered is the number of messages currently waiting in the buffer.
+	Buffered int
+	Flushed  uint64
+	Dropped  uint64
+	Rejected uint64
+	// Failed is the number of buffered messages discarded because publishing them failed for another reason than
+	// the connection, or because they could not be read back from the disk.
+	Failed uint64
+}
+
+// bufferStore holds the buffered messages in order.
+type bufferStore interface {
+	push(message outgoingMessage) error
+	peek() (outgoingMessage, bool, error)
+	pop() error
+	// quarantine removes the oldest message because it can't be read, keeping it aside if possible.
+	quarantine() error
+	len() int
+}
+
+// errCorruptMessage is returned when a buffered message can't be decoded.
+var errCorruptMessage = errors.New("corrupt buffered message")
+
+type publishBuffer struct {
+	mu     sync.Mutex
+	store  bufferStore
+	config PublishBufferConfig
+	stats  BufferStats
+	// removed counts the messages taken out of the store, telling flush whether the oldest message
+	// is still the one it sent
+	removed  uint64
+	room     chan struct{}
+	pending  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	logger   xlog.Logger
+}
+
+func newPublishBuffer(config PublishBufferConfig, logger xlog.Logger) (*publishBuffer, error) {
+	if config.Capacity <= 0 {
+		return nil, fmt.Errorf("capacity must be positive, got %d", config.Capacity)
+	}
+
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Second
+	}
+
+	var store bufferStore = &memoryStore{}
+	if config.Directory != "" {
+		disk, err := newDiskStore(config.Directory)
+		if err != nil {
+			return nil, err
+		}
+		store = disk
+	}
+
+	return &publishBuffer{
+		store:   store,
+		config:  config,
+		room:    make(chan struct{}),
+		pending: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		logger:  logger,
+	}, nil
+}
+
+// publish sends the message right away when nothing is waiting in the buffer,
+// and buffers it if RabbitMQ can't be reached or if older messages are still waiting.
+func (b *publishBuffer) publish(ctx context.Context, message outgoingMessage, send func(context.Context, outgoingMessage) error) error {
+	b.mu.Lock()
+	if b.store.len() == 0 {
+		b.mu.Unlock()
+
+		err := send(ctx, message)
+		if err == nil || !isConnectionError(err) {
+			return err
+		}
+
+		b.mu.Lock()
+	}
+	defer b.mu.Unlock()
+
+	for b.store.len() >= b.config.Capacity {
+		switch b.config.Overflow {
+		case OverflowDropOldest:
+			if err := b.store.pop(); err != nil {
+				return fmt.Errorf("failed to drop oldest buffered message: %w", err)
+			}
+			b.removed++
+			b.stats.Dropped++
+			b.logger.Warning("publish buffer is full, dropped oldest message")
+		case OverflowError:
+			b.stats.Rejected++
+			return ErrBufferFull
+		default:
+			room := b.room
+			b.mu.Unlock()
+			select {
+			case <-room:
+			case <-ctx.Done():
+				b.mu.Lock()
+				return fmt.Errorf("failed to wait for room in publish buffer: %w", ctx.Err())
+			}
+			b.mu.Lock()
+		}
+	}
+
+	if err := b.store.push(message); err != nil {
+		return fmt.Errorf("failed to buffer message: %w", err)
+	}
+
+	select {
+	case b.pending <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// run flushes the buffer until it is closed, right away when the connection is back.
+func (b *publishBuffer) run(send func(context.Context, outgoingMessage) error, states <-chan State) {
+	ticker := time.NewTicker(b.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case state, ok := <-states:
+			if !ok {
+				// the connection is closed for good, there is nothing left to flush to
+				return
+			}
+			if state != StateConnected {
+				continue
+			}
+		case <-b.pending:
+		case <-ticker.C:
+		}
+
+		if err := b.flush(send); err != nil {
+			b.logger.Warning("failed to flush publish buffer", lf.Int("buffered", b.Stats().Buffered), lf.Err(err))
+		}
+	}
+}
+
+// flush publishes the buffered messages in order, stopping once RabbitMQ can't be reached.
+//
+// Other failures would block the buffer for good, so the messages causing them are discarded.
+// A message dropped to make room while it is being sent (see OverflowDropOldest) is only counted as dropped.
+func (b *publishBuffer) flush(send func(context.Context, outgoingMessage) error) error {
+	for {
+		b.mu.Lock()
+		message, ok, err := b.store.peek()
+		if errors.Is(err, errCorruptMessage) {
+			b.logger.Error("discarding unreadable buffered message", lf.Err(err))
+			err = b.remove(b.store.quarantine, &b.stats.Failed)
+			b.mu.Unlock()
+			if err != nil {
+				return fmt.Errorf("failed to quarantine buffered message: %w", err)
+			}
+			continue
+		}
+		removed := b.removed
+		b.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to read buffered message: %w", err)
+		}
+		if !ok {
+			return nil
+		}
+
+		counter := &b.stats.Flushed
+		if err := send(context.Background(), message); err != nil {
+			if isConnectionError(err) {
+				return err
+			}
+
+			b.logger.Error("discarding buffered message that failed to publish",
+				lf.String("message_id", message.Payload.MessageID),
+				lf.String("topic", message.Payload.Topic),
+				lf.Err(err),
+			)
+			counter = &b.stats.Failed
+		}
+
+		b.mu.Lock()
+		if b.removed != removed {
+			// the message was dropped while being sent, the oldest one now was not sent yet
+			b.mu.Unlock()
+			continue
+		}
+		err = b.remove(b.store.pop, counter)
+		b.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to remove buffered message: %w", err)
+		}
+	}
+}
+
+// remove takes the oldest message out of the store and counts it, it must be called with the mutex held.
+func (b *publishBuffer) remove(remove func() error, counter *uint64) error {
+	if err := remove(); err != nil {
+		return err
+	}
+
+	b.removed++
+	*counter++
+	// wake up the publishers waiting for room
+	close(b.room)
+	b.room = make(chan struct{})
+	return nil
+}
+
+func (b *publishBuffer) Stats() BufferStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := b.stats
+	stats.Buffered = b.store.len()
+	return stats
+}
+
+func (b *publishBuffer) close() {
+	b.stopOnce.Do(func() { close(b.stop) })
+}
+
+type memoryStore struct {
+	messages []outgoingMessage
+}
+
+func (s *memoryStore) push(message outgoingMessage) error {
+	s.messages = append(s.messages, message)
+	return nil
+}
+
+func (s *memoryStore) peek() (outgoingMessage, bool, error) {
+	if len(s.messages) == 0 {
+		return outgoingMessage{}, false, nil
+	}
+	return s.messages[0], true, nil
+}
+
+func (s *memoryStore) pop() error {
+	if len(s.messages) > 0 {
+		s.messages = slices.Delete(s.messages, 0, 1)
+	}
+	return nil
+}
+
+func (s *memoryStore) quarantine() error {
+	return s.pop()
+}
+
+func (s *memoryStore) len() int {
+	return len(s.messages)
+}
+
+func init() {
+	// the types that can be found in the headers of the buffered messages
+	gob.Register(amqp091.Table{})
+	gob.Register([]any{})
+	gob.Register(time.Time{})
+}
+
+// diskStore keeps each buffered message in its own file, named after its position in the buffer.
+type diskStore struct {
+	directory string
+	sequences []uint64
+	next      uint64
+}
+
+const (
+	diskStoreExtension           = ".msg"
+	diskStoreQuarantineExtension = ".corrupt"
+)
+
+func newDiskStore(directory string) (*diskStore, error) {
+	if err := os.MkdirAll(directory, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create buffer directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read buffer directory: %w", err)
+	}
+
+	s := &diskStore{directory: directory}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), diskStoreExtension)
+		if !ok {
+			continue
+		}
+
+		sequence, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.sequences = append(s.sequences, sequence)
+		s.next = max(s.next, sequence+1)
+	}
+	slices.Sort(s.sequences)
+
+	return s, nil
+}
+
+func (s *diskStore) path(sequence uint64) string {
+	return filepath.Join(s.directory, fmt.Sprintf("%020d%s", sequence, diskStoreExtension))
+}
+
+func (s *diskStore) push(message outgoingMessage) error {
+	// write to a temporary file first, so that a crash never leaves a partial message behind
+	tmp, err := os.CreateTemp(s.directory, "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if err := gob.NewEncoder(tmp).Encode(message); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), s.path(s.next)); err != nil {
+		return err
+	}
+
+	s.sequences = append(s.sequences, s.next)
+	s.next++
+	return nil
+}
+
+func (s *diskStore) peek() (outgoingMessage, bool, error) {
+	if len(s.sequences) == 0 {
+		return outgoingMessage{}, false, nil
+	}
+
+	f, err := os.Open(s.path(s.sequences[0]))
+	if err != nil {
+		return outgoingMessage{}, false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	message := outgoingMessage{}
+	if err := gob.NewDecoder(f).Decode(&message); err != nil {
+		return outgoingMessage{}, false, fmt.Errorf("%w %s: %w", errCorruptMessage, f.Name(), err)
+	}
+
+	return message, true, nil
+}
+
+func (s *diskStore) pop() error {
+	if len(s.sequences) == 0 {
+		return nil
+	}
+
+	if err := os.Remove(s.path(s.sequences[0])); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	s.sequences = s.sequences[1:]
+	return nil
+}
+
+// quarantine renames the oldest message file so that it is kept for inspection, but not loaded anymore.
+func (s *diskStore) quarantine() error {
+	if len(s.sequences) == 0 {
+		return nil
+	}
+
+	path := s.path(s.sequences[0])
+	if err := os.Rename(path, path+diskStoreQuarantineExtension); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	s.sequences = s.sequences[1:]
+	return nil
+}
+
+func (s *diskStore) len() int {
+	return len(s.sequences)
+}
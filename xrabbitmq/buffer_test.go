@@ -0,0 +1,267 @@
+package xrabbitmq
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raphoester/x/xlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBroker stands for RabbitMQ, failing like a closed connection while it is down.
+type fakeBroker struct {
+	mu       sync.Mutex
+	down     bool
+	received []string
+}
+
+func (f *fakeBroker) send(_ context.Context, message outgoingMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.down {
+		return ErrConnectionClosed
+	}
+
+	f.received = append(f.received, message.Payload.MessageID)
+	return nil
+}
+
+func (f *fakeBroker) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *fakeBroker) messages() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.received...)
+}
+
+func newTestBuffer(t *testing.T, capacity int, overflow OverflowPolicy, directory string) *publishBuffer {
+	config := PublishBufferConfig{}
+	config.ResetToDefault()
+	config.Enabled = true
+	config.Capacity = capacity
+	config.Overflow = overflow
+	config.Directory = directory
+
+	buffer, err := newPublishBuffer(config, xlog.NopLogger{})
+	require.NoError(t, err)
+	return buffer
+}
+
+func TestBufferFlushesInOrderAfterOutage(t *testing.T) {
+	for name, directory := range map[string]string{"memory": "", "disk": t.TempDir()} {
+		t.Run(name, func(t *testing.T) {
+			broker := &fakeBroker{}
+			buffer := newTestBuffer(t, 10, OverflowError, directory)
+			ctx := context.Background()
+
+			require.NoError(t, buffer.publish(ctx, outgoingMessage{Payload: Payload{MessageID: "1"}}, broker.send))
+
+			broker.setDown(true)
+			require.NoError(t, buffer.publish(ctx, outgoingMessage{Payload: Payload{MessageID: "2"}}, broker.send))
+
+			// once the connection is back, new messages still wait behind the buffered ones
+			broker.setDown(false)
+			require.NoError(t, buffer.publish(ctx, outgoingMessage{Payload: Payload{MessageID: "3", Headers: map[string]any{"x-schema-version": int32(2)}}}, broker.send))
+			assert.Equal(t, []string{"1"}, broker.messages())
+			assert.Equal(t, 2, buffer.Stats().Buffered)
+
+			require.NoError(t, buffer.flush(broker.send))
+			assert.Equal(t, []string{"1", "2", "3"}, broker.messages())
+			assert.Equal(t, BufferStats{Flushed: 2}, buffer.Stats())
+		})
+	}
+}
+
+func TestBufferOverflow(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("error", func(t *testing.T) {
+		broker := &fakeBroker{down: true}
+		buffer := newTestBuffer(t, 1, OverflowError, "")
+
+		require.NoError(t, buffer.publish(ctx, outgoingMessage{Payload: Payload{MessageID: "1"}}, broker.send))
+		assert.ErrorIs(t, buffer.publish(ctx, outgoingMessage{Payload: Payload{MessageID: "2"}}, broker.send), ErrBufferFull)
+		assert.Equal(t, BufferStats{Buffered: 1, Rejected: 1}, buffer.Stats())
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		broker := &fakeBroker{down: true}
+		buffer := newTestBuffer(t, 2, OverflowDropOldest, "")
+
+		for _, id := range []string{"1", "2", "3"} {
+			require.NoError(t, buffer.publish(ctx, outgoingMessage{Payload: Payload{MessageID: id}}, broker.send))
+		}
+
+		broker.setDown(false)
+		require.NoError(t, buffer.flush(broker.send))
+		assert.Equal(t, []string{"2", "3"}, broker.messages())
+		assert.Equal(t, BufferStats{Flushed: 2, Dropped: 1}, buffer.Stats())
+	})
+
+	t.Run("block", func(t *testing.T) {
+		broker := &fakeBroker{down: true}
+		buffer := newTestBuffer(t, 1, OverflowBlock, "")
+		require.NoError(t, buffer.publish(ctx, outgoingMessage{Payload: Payload{MessageID: "1"}}, broker.send))
+
+		timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, buffer.publish(timeout, outgoingMessage{Payload: Payload{MessageID: "2"}}, broker.send), context.DeadlineExceeded)
+
+		published := make(chan error)
+		go func() {
+			published <- buffer.publish(ctx, outgoingMessage{Payload: Payload{MessageID: "3"}}, broker.send)
+		}()
+
+		broker.setDown(false)
+		require.Eventually(t, func() bool {
+			_ = buffer.flush(broker.send)
+			select {
+			case err := <-published:
+				require.NoError(t, err)
+				return true
+			default:
+				return false
+			}
+		}, time.Second, time.Millisecond)
+
+		require.NoError(t, buffer.flush(broker.send))
+		assert.Equal(t, []string{"1", "3"}, broker.messages())
+	})
+}
+
+func TestBufferDoesNotHoldOtherErrors(t *testing.T) {
+	buffer := newTestBuffer(t, 1, OverflowError, "")
+	failure := errors.New("precondition failed")
+
+	err := buffer.publish(context.Background(), outgoingMessage{Payload: Payload{}}, func(context.Context, outgoingMessage) error { return failure })
+	assert.ErrorIs(t, err, failure)
+	assert.Zero(t, buffer.Stats().Buffered)
+}
+
+func TestDiskBufferSurvivesRestart(t *testing.T) {
+	directory := t.TempDir()
+	broker := &fakeBroker{down: true}
+
+	buffer := newTestBuffer(t, 10, OverflowError, directory)
+	for _, id := range []string{"1", "2"} {
+		require.NoError(t, buffer.publish(context.Background(), outgoingMessage{Payload: Payload{MessageID: id}}, broker.send))
+	}
+	buffer.close()
+
+	broker.setDown(false)
+	restarted := newTestBuffer(t, 10, OverflowError, directory)
+	assert.Equal(t, 2, restarted.Stats().Buffered)
+	require.NoError(t, restarted.flush(broker.send))
+	assert.Equal(t, []string{"1", "2"}, broker.messages())
+}
+
+func TestBufferRequiresCapacity(t *testing.T) {
+	config := PublishBufferConfig{}
+	config.ResetToDefault()
+	config.Enabled = true
+	config.Capacity = 0
+
+	_, err := newPublishBuffer(config, xlog.NopLogger{})
+	assert.Error(t, err)
+}
+
+func TestBufferDiscardsMessagesThatCantBePublished(t *testing.T) {
+	broker := &fakeBroker{down: true}
+	buffer := newTestBuffer(t, 10, OverflowError, "")
+	for _, id := range []string{"1", "2", "3"} {
+		require.NoError(t, buffer.publish(context.Background(), outgoingMessage{Payload: Payload{MessageID: id}}, broker.send))
+	}
+
+	broker.setDown(false)
+	send := func(ctx context.Context, message outgoingMessage) error {
+		if message.Payload.MessageID == "2" {
+			return ErrUnroutable
+		}
+		return broker.send(ctx, message)
+	}
+
+	require.NoError(t, buffer.flush(send))
+	assert.Equal(t, []string{"1", "3"}, broker.messages())
+	assert.Equal(t, BufferStats{Flushed: 2, Failed: 1}, buffer.Stats())
+}
+
+func TestDiskBufferQuarantinesCorruptMessages(t *testing.T) {
+	directory := t.TempDir()
+	broker := &fakeBroker{down: true}
+
+	buffer := newTestBuffer(t, 10, OverflowError, directory)
+	for _, id := range []string{"1", "2"} {
+		require.NoError(t, buffer.publish(context.Background(), outgoingMessage{Payload: Payload{MessageID: id}}, broker.send))
+	}
+
+	store := buffer.store.(*diskStore)
+	corrupt := store.path(store.sequences[0])
+	require.NoError(t, os.WriteFile(corrupt, []byte("not gob"), 0o644))
+
+	broker.setDown(false)
+	require.NoError(t, buffer.flush(broker.send))
+	assert.Equal(t, []string{"2"}, broker.messages())
+	assert.Equal(t, BufferStats{Flushed: 1, Failed: 1}, buffer.Stats())
+	assert.FileExists(t, corrupt+diskStoreQuarantineExtension)
+
+	restarted := newTestBuffer(t, 10, OverflowError, directory)
+	assert.Zero(t, restarted.Stats().Buffered)
+}
+
+func TestBufferDropsOldestWhileFlushing(t *testing.T) {
+	broker := &fakeBroker{down: true}
+	buffer := newTestBuffer(t, 2, OverflowDropOldest, "")
+	ctx := context.Background()
+	for _, id := range []string{"1", "2"} {
+		require.NoError(t, buffer.publish(ctx, outgoingMessage{Payload: Payload{MessageID: id}}, broker.send))
+	}
+
+	broker.setDown(false)
+	sending := make(chan struct{})
+	release := make(chan struct{})
+	send := func(ctx context.Context, message outgoingMessage) error {
+		if message.Payload.MessageID == "1" {
+			close(sending)
+			<-release
+		}
+		return broker.send(ctx, message)
+	}
+
+	flushed := make(chan error)
+	go func() { flushed <- buffer.flush(send) }()
+
+	// the message being sent is the oldest one, dropping it must not discard the next one
+	<-sending
+	require.NoError(t, buffer.publish(ctx, outgoingMessage{Payload: Payload{MessageID: "3"}}, broker.send))
+	close(release)
+
+	require.NoError(t, <-flushed)
+	assert.Equal(t, []string{"1", "2", "3"}, broker.messages())
+	assert.Equal(t, BufferStats{Flushed: 2, Dropped: 1}, buffer.Stats())
+}
+
+func TestDiskBufferKeepsDelays(t *testing.T) {
+	directory := t.TempDir()
+	broker := &fakeBroker{down: true}
+	deliverAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	buffer := newTestBuffer(t, 10, OverflowError, directory)
+	require.NoError(t, buffer.publish(context.Background(), outgoingMessage{Payload: Payload{MessageID: "1"}, DeliverAt: deliverAt}, broker.send))
+	buffer.close()
+
+	restarted := newTestBuffer(t, 10, OverflowError, directory)
+	message, ok, err := restarted.store.peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.True(t, deliverAt.Equal(message.DeliverAt))
+}
@@ -0,0 +1,55 @@
+package xrabbitmq_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/raphoester/x/xdockertest"
+	"github.com/raphoester/x/xlog"
+	"github.com/raphoester/x/xrabbitmq"
+)
+
+// BenchmarkConcurrentPublish measures the publish throughput depending on the size of the channel pool.
+func BenchmarkConcurrentPublish(b *testing.B) {
+	rabbitMQ, err := xdockertest.NewRabbitMQ(xlog.NopLogger{})
+	if err != nil {
+		b.Skipf("rabbitmq is not available: %v", err)
+	}
+	defer func() { _ = rabbitMQ.Destroy() }()
+
+	for _, channels := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("%d channels", channels), func(b *testing.B) {
+			config := xrabbitmq.Config{}
+			config.ResetToDefault()
+			config.URL = rabbitMQ.URL
+			config.ExchangeName = "x-dockertest-exchange-name"
+			config.RetryDelay = time.Second
+			config.PublishChannels = channels
+
+			client, err := xrabbitmq.NewClient(xlog.NopLogger{}, config)
+			if err != nil {
+				b.Fatalf("failed to create client: %v", err)
+			}
+			b.Cleanup(func() { _ = client.Close() })
+
+			payload := xrabbitmq.Payload{
+				Topic:       "benchmark",
+				ContentType: "application/json",
+				Body:        []byte(`{"key":"value"}`),
+			}
+
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := client.Publish(context.Background(), payload); err != nil {
+						b.Errorf("failed to publish: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
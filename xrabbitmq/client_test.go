@@ -0,0 +1,444 @@
+package xrabbitmq_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/raphoester/x/xdockertest"
+	"github.com/raphoester/x/xerrs"
+	"github.com/raphoester/x/xlog"
+	"github.com/raphoester/x/xrabbitmq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+func TestRunSuite(t *testing.T) {
+	suite.Run(t, new(testSuite))
+}
+
+type testSuite struct {
+	suite.Suite
+	rabbitMQ *xdockertest.RabbitMQ
+}
+
+func (s *testSuite) SetupSuite() {
+	rabbitMQ, err := xdockertest.NewRabbitMQ(xlog.NewTestLogger(s.T()))
+	s.Require().NoError(err)
+	s.rabbitMQ = rabbitMQ
+}
+
+func (s *testSuite) TearDownSuite() {
+	if err := s.rabbitMQ.Destroy(); err != nil {
+		s.T().Errorf("failed to destroy rabbitMQ: %v", err)
+	}
+}
+
+func (s *testSuite) newClient(configure func(config *xrabbitmq.Config)) *xrabbitmq.Client {
+	config := xrabbitmq.Config{}
+	config.ResetToDefault()
+	config.URL = s.rabbitMQ.URL
+	config.ExchangeName = "x-dockertest-exchange-name"
+	config.RetryDelay = time.Second
+	configure(&config)
+
+	client, err := xrabbitmq.NewClient(xlog.NewTestLogger(s.T()), config)
+	s.Require().NoError(err)
+	s.T().Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+func (s *testSuite) TestMandatoryPublishOfUnroutableMessage() {
+	client := s.newClient(func(config *xrabbitmq.Config) {
+		config.Mandatory = true
+	})
+
+	err := client.Publish(context.Background(), xrabbitmq.Payload{
+		Topic:     "topic.without.queue",
+		MessageID: "unroutable",
+		Body:      []byte("{}"),
+	})
+	s.Assert().ErrorIs(err, xrabbitmq.ErrUnroutable)
+}
+
+func (s *testSuite) TestMandatoryPublishRequiresMessageIDs() {
+	client := s.newClient(func(config *xrabbitmq.Config) {
+		config.Mandatory = true
+	})
+
+	err := client.Publish(context.Background(), xrabbitmq.Payload{Topic: "topic.without.id", Body: []byte("{}")})
+	s.Assert().ErrorIs(err, xrabbitmq.ErrMessageIDRequired)
+
+	err = client.PublishBatch(context.Background(),
+		xrabbitmq.Payload{Topic: "topic.duplicate", MessageID: "same", Body: []byte("{}")},
+		xrabbitmq.Payload{Topic: "topic.duplicate", MessageID: "same", Body: []byte("{}")},
+	)
+	s.Assert().ErrorIs(err, xrabbitmq.ErrMessageIDRequired)
+}
+
+func (s *testSuite) TestPublisherConfirms() {
+	client := s.newClient(func(config *xrabbitmq.Config) {
+		config.PublisherConfirms = true
+		config.Mandatory = true
+	})
+
+	received := make(chan string, 1)
+	stream, err := client.Stream(context.Background(), "confirms", []string{"topic.confirms"}, func(ctx context.Context, delivery amqp091.Delivery) error {
+		received <- delivery.MessageId
+		return nil
+	})
+	s.Require().NoError(err)
+	defer func() { _ = stream.Stop(context.Background()) }()
+
+	err = client.Publish(context.Background(), xrabbitmq.Payload{
+		Topic:     "topic.confirms",
+		MessageID: "routed",
+		Body:      []byte("{}"),
+	})
+	s.Require().NoError(err)
+
+	select {
+	case id := <-received:
+		s.Assert().Equal("routed", id)
+	case <-time.After(10 * time.Second):
+		s.Fail("message was not received")
+	}
+
+	// a batch mixing routable and unroutable messages only fails the latter
+	err = client.PublishBatch(context.Background(),
+		xrabbitmq.Payload{Topic: "topic.confirms", MessageID: "first", Body: []byte("{}")},
+		xrabbitmq.Payload{Topic: "topic.without.queue", MessageID: "second", Body: []byte("{}")},
+	)
+	var batchErr *xrabbitmq.BatchError
+	s.Require().ErrorAs(err, &batchErr)
+	s.Assert().NoError(batchErr.Errors[0])
+	s.Assert().ErrorIs(batchErr.Errors[1], xrabbitmq.ErrUnroutable)
+}
+
+func (s *testSuite) TestStreamFailsOnQueueMismatch() {
+	client := s.newClient(func(config *xrabbitmq.Config) {})
+
+	stream, err := client.Stream(context.Background(), "mismatch", []string{"topic.mismatch"}, func(ctx context.Context, delivery amqp091.Delivery) error {
+		return nil
+	}, xrabbitmq.WithQueueOptions(xrabbitmq.QueueOptions{Quorum: true}))
+	s.Require().NoError(err)
+	s.Require().NoError(stream.Stop(context.Background()))
+
+	_, err = client.Stream(context.Background(), "mismatch", []string{"topic.mismatch"}, func(ctx context.Context, delivery amqp091.Delivery) error {
+		return nil
+	})
+	s.Assert().Error(err)
+	s.Assert().True(xerrs.IsPermanent(err))
+}
+
+func (s *testSuite) TestStreamRestartsAfterQueueDeletion() {
+	client := s.newClient(func(config *xrabbitmq.Config) {})
+
+	received := make(chan string, 1)
+	stream, err := client.Stream(context.Background(), "restarts", []string{"topic.restarts"}, func(ctx context.Context, delivery amqp091.Delivery) error {
+		received <- delivery.MessageId
+		return nil
+	})
+	s.Require().NoError(err)
+	defer func() { _ = stream.Stop(context.Background()) }()
+	s.Assert().True(stream.Healthy())
+
+	ch, err := client.Connection().GetChannel()
+	s.Require().NoError(err)
+	_, err = ch.QueueDelete("restarts", false, false, false)
+	s.Require().NoError(err)
+	_ = ch.Close()
+
+	// the consumer is cancelled by the deletion, then declares the queue again
+	s.Require().Eventually(func() bool {
+		health := stream.Health()[0]
+		return health.Status == xrabbitmq.ConsumerConsuming && health.Restarts == 1
+	}, 10*time.Second, 100*time.Millisecond)
+
+	err = client.Publish(context.Background(), xrabbitmq.Payload{
+		Topic:     "topic.restarts",
+		MessageID: "after-restart",
+		Body:      []byte("{}"),
+	})
+	s.Require().NoError(err)
+
+	select {
+	case id := <-received:
+		s.Assert().Equal("after-restart", id)
+	case <-time.After(5 * time.Second):
+		s.Fail("message not received after restart")
+	}
+}
+
+func (s *testSuite) TestStreamQueueReplay() {
+	client := s.newClient(func(config *xrabbitmq.Config) {})
+
+	listen := func(received chan<- string, opts ...xrabbitmq.StreamOption) *xrabbitmq.Stream {
+		opts = append(opts, xrabbitmq.WithQueueOptions(xrabbitmq.QueueOptions{Stream: true}))
+		stream, err := client.Stream(context.Background(), "replay", []string{"topic.replay"}, func(ctx context.Context, delivery amqp091.Delivery) error {
+			received <- delivery.MessageId
+			return nil
+		}, opts...)
+		s.Require().NoError(err)
+		return stream
+	}
+
+	publish := func(ids ...string) {
+		for _, id := range ids {
+			s.Require().NoError(client.Publish(context.Background(), xrabbitmq.Payload{
+				Topic:     "topic.replay",
+				MessageID: id,
+				Body:      []byte("{}"),
+			}))
+		}
+	}
+
+	receive := func(received <-chan string, count int) []string {
+		ids := make([]string, 0, count)
+		for range count {
+			select {
+			case id := <-received:
+				ids = append(ids, id)
+			case <-time.After(10 * time.Second):
+				s.FailNow("messages not received", "got %v", ids)
+			}
+		}
+		return ids
+	}
+
+	received := make(chan string, 10)
+	stream := listen(received, xrabbitmq.WithOffsetTracking("projection"), xrabbitmq.WithOffset(xrabbitmq.OffsetFirst()))
+	publish("1", "2", "3")
+	s.Assert().Equal([]string{"1", "2", "3"}, receive(received, 3))
+	s.Require().NoError(stream.Stop(context.Background()))
+
+	// the tracked offset has precedence over the initial one
+	publish("4", "5")
+	stream = listen(received, xrabbitmq.WithOffsetTracking("projection"), xrabbitmq.WithOffset(xrabbitmq.OffsetFirst()))
+	s.Assert().Equal([]string{"4", "5"}, receive(received, 2))
+	s.Require().NoError(stream.Stop(context.Background()))
+
+	// acked messages are still there to be replayed
+	stream = listen(received, xrabbitmq.WithOffset(xrabbitmq.OffsetAt(1)))
+	s.Assert().Equal([]string{"2", "3", "4", "5"}, receive(received, 4))
+	s.Require().NoError(stream.Stop(context.Background()))
+}
+
+func (s *testSuite) TestStreamQueueDeadLettersFailingDeliveries() {
+	client := s.newClient(func(config *xrabbitmq.Config) {
+		config.Retry = xrabbitmq.RetryPolicy{MaxAttempts: 2, InitialDelay: 10 * time.Millisecond}
+	})
+
+	received := make(chan string, 10)
+	stream, err := client.Stream(context.Background(), "replay.failing", []string{"topic.replay.failing"}, func(ctx context.Context, delivery amqp091.Delivery) error {
+		if delivery.MessageId == "poison" {
+			return errors.New("cannot handle")
+		}
+		received <- delivery.MessageId
+		return nil
+	}, xrabbitmq.WithQueueOptions(xrabbitmq.QueueOptions{Stream: true}))
+	s.Require().NoError(err)
+	defer func() { _ = stream.Stop(context.Background()) }()
+
+	for _, id := range []string{"poison", "after"} {
+		s.Require().NoError(client.Publish(context.Background(), xrabbitmq.Payload{
+			Topic:     "topic.replay.failing",
+			MessageID: id,
+			Body:      []byte("{}"),
+		}))
+	}
+
+	// the poison message holds the stream back only until its attempts are exhausted
+	select {
+	case id := <-received:
+		s.Assert().Equal("after", id)
+	case <-time.After(10 * time.Second):
+		s.FailNow("stream stalled on the failing delivery")
+	}
+
+	deadLetters, err := client.DeadLetters(context.Background(), "replay.failing", 10)
+	s.Require().NoError(err)
+	s.Require().Len(deadLetters, 1)
+	s.Assert().Equal("poison", deadLetters[0].MessageID)
+	s.Assert().Equal(2, deadLetters[0].Attempts)
+}
+
+func (s *testSuite) TestRequest() {
+	client := s.newClient(func(config *xrabbitmq.Config) {})
+
+	handled := make(chan struct{}, 1)
+	stream, err := client.Serve(context.Background(), "requests.slow", func(ctx context.Context, request xrabbitmq.Payload) (xrabbitmq.Payload, error) {
+		handled <- struct{}{}
+		<-ctx.Done()
+		return xrabbitmq.Payload{}, ctx.Err()
+	})
+	s.Require().NoError(err)
+	defer func() { _ = stream.Stop(context.Background()) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	_, err = client.Request(ctx, "requests.slow", xrabbitmq.Payload{Body: []byte("{}")})
+	s.Assert().ErrorIs(err, context.DeadlineExceeded)
+	<-handled
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream2, err := client.Serve(ctx, "requests.echo", func(ctx context.Context, request xrabbitmq.Payload) (xrabbitmq.Payload, error) {
+		return xrabbitmq.Payload{Body: []byte(request.Topic + ":" + string(request.Body))}, nil
+	})
+	s.Require().NoError(err)
+	defer func() { _ = stream2.Stop(context.Background()) }()
+
+	// requests don't go through the exchange of the events
+	events := make(chan string, 1)
+	stream3, err := client.Stream(ctx, "requests.events", []string{"requests.#"}, func(ctx context.Context, delivery amqp091.Delivery) error {
+		events <- delivery.MessageId
+		return nil
+	})
+	s.Require().NoError(err)
+	defer func() { _ = stream3.Stop(context.Background()) }()
+
+	reply, err := client.Request(ctx, "requests.echo", xrabbitmq.Payload{Body: []byte("ping")})
+	s.Require().NoError(err)
+	s.Assert().Equal([]byte("requests.echo:ping"), reply.Body)
+
+	select {
+	case id := <-events:
+		s.Failf("request received as an event", "message %s", id)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestPayloadFromDelivery(t *testing.T) {
+	payload := xrabbitmq.PayloadFromDelivery(amqp091.Delivery{
+		RoutingKey:    "topic",
+		MessageId:     "id",
+		CorrelationId: "correlation",
+		ReplyTo:       "replies",
+		Priority:      4,
+		Expiration:    "1500",
+		Type:          "type",
+		AppId:         "app",
+		UserId:        "guest",
+	})
+
+	assert.Equal(t, xrabbitmq.Payload{
+		Topic:         "topic",
+		MessageID:     "id",
+		CorrelationID: "correlation",
+		ReplyTo:       "replies",
+		Priority:      4,
+		Expiration:    1500 * time.Millisecond,
+		Type:          "type",
+		AppID:         "app",
+		UserID:        "guest",
+	}, payload)
+}
+
+func (s *testSuite) TestApplyTopology() {
+	client := s.newClient(func(config *xrabbitmq.Config) {})
+	ctx := context.Background()
+
+	topology := xrabbitmq.Topology{
+		Exchanges: []xrabbitmq.ExchangeSpec{
+			{Name: "topology.source", Type: amqp091.ExchangeTopic, Durable: true},
+			{Name: "topology.copy", Type: amqp091.ExchangeFanout, Durable: true},
+		},
+		Queues: []xrabbitmq.QueueSpec{
+			{Name: "topology.queue", Durable: true, Arguments: map[string]any{"x-max-length": 10}},
+		},
+		Bindings: []xrabbitmq.BindingSpec{
+			{Source: "topology.source", Destination: "topology.copy", DestinationType: xrabbitmq.DestinationExchange, RoutingKey: "#"},
+			{Source: "topology.copy", Destination: "topology.queue"},
+		},
+	}
+
+	report, err := client.ApplyTopology(ctx, topology)
+	s.Require().NoError(err)
+	s.Assert().Equal([]string{"exchange topology.source", "exchange topology.copy", "queue topology.queue"}, report.Created)
+	s.Assert().Empty(report.Drifts)
+
+	report, err = client.ApplyTopology(ctx, topology)
+	s.Require().NoError(err)
+	s.Assert().Equal(xrabbitmq.TopologyReport{}, report, "applying again changes nothing")
+
+	topology.Queues[0].Arguments["x-max-length"] = 20
+	report, err = client.ApplyTopology(ctx, topology)
+	s.Require().NoError(err)
+	s.Require().Len(report.Drifts, 1)
+	s.Assert().Equal("topology.queue", report.Drifts[0].Name)
+
+	topology.Strict = true
+	_, err = client.ApplyTopology(ctx, topology)
+	s.Assert().ErrorIs(err, xrabbitmq.ErrTopologyDrift)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = client.ApplyTopology(canceled, topology)
+	s.Assert().ErrorIs(err, context.Canceled)
+}
+
+func (s *testSuite) TestApplyTopologyReportsExtraBindings() {
+	client := s.newClient(func(config *xrabbitmq.Config) {})
+	ctx := context.Background()
+
+	topology := xrabbitmq.Topology{
+		Exchanges: []xrabbitmq.ExchangeSpec{{Name: "extra.source", Type: amqp091.ExchangeTopic, Durable: true}},
+		Queues:    []xrabbitmq.QueueSpec{{Name: "extra.queue", Durable: true}},
+		Bindings: []xrabbitmq.BindingSpec{
+			{Source: "extra.source", Destination: "extra.queue", RoutingKey: "kept"},
+			{Source: "extra.source", Destination: "extra.queue", RoutingKey: "removed"},
+		},
+		ManagementURL: s.rabbitMQ.ManagementURL,
+	}
+
+	report, err := client.ApplyTopology(ctx, topology)
+	s.Require().NoError(err)
+	s.Assert().Empty(report.Drifts)
+
+	topology.Bindings = topology.Bindings[:1]
+	report, err = client.ApplyTopology(ctx, topology)
+	s.Require().NoError(err)
+	s.Require().Len(report.Drifts, 1)
+	s.Assert().Equal("binding", report.Drifts[0].Kind)
+	s.Assert().Equal("extra.source -> queue extra.queue", report.Drifts[0].Name)
+
+	topology.Strict = true
+	_, err = client.ApplyTopology(ctx, topology)
+	s.Assert().ErrorIs(err, xrabbitmq.ErrTopologyDrift)
+}
+
+func (s *testSuite) TestPublishAfter() {
+	client := s.newClient(func(config *xrabbitmq.Config) {
+		config.DelayPrecision = 100 * time.Millisecond
+		// delayed messages are confirmed like the other ones
+		config.PublisherConfirms = true
+		config.Mandatory = true
+	})
+
+	received := make(chan time.Time, 1)
+	stream, err := client.Stream(context.Background(), "delayed", []string{"topic.delayed"}, func(ctx context.Context, delivery amqp091.Delivery) error {
+		received <- time.Now()
+		return nil
+	})
+	s.Require().NoError(err)
+	defer func() { _ = stream.Stop(context.Background()) }()
+
+	start := time.Now()
+	err = client.PublishAfter(context.Background(), xrabbitmq.Payload{
+		Topic:     "topic.delayed",
+		MessageID: "delayed",
+		Body:      []byte("{}"),
+	}, time.Second)
+	s.Require().NoError(err)
+
+	select {
+	case at := <-received:
+		s.Assert().GreaterOrEqual(at.Sub(start), time.Second)
+	case <-time.After(10 * time.Second):
+		s.Fail("delayed message not received")
+	}
+}
@@ -3,6 +3,7 @@ package xrabbitmq
 import (
 	"errors"
 	"fmt"
+	"math/rand/v2"
 	"sync"
 	"time"
 
@@ -11,21 +12,108 @@ import (
 	"github.com/raphoester/x/xlog/lf"
 )
 
+// ErrConnectionClosed is returned while the connection to RabbitMQ is down.
+var ErrConnectionClosed = errors.New("connection is closed")
+
+// ReconnectPolicy tells how to wait between the attempts at reconnecting once the connection was lost.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration `yaml:"initial_delay"`
+	MaxDelay     time.Duration `yaml:"max_delay"`
+	Multiplier   float64       `yaml:"multiplier"`
+
+	// Jitter is the fraction of the delay randomly added or removed, so that clients don't all reconnect at once.
+	Jitter float64 `yaml:"jitter"`
+
+	// MaxAttempts is the number of attempts after which the connection is closed for good.
+	// Zero means reconnecting forever.
+	MaxAttempts int `yaml:"max_attempts"`
+}
+
+func (p *ReconnectPolicy) ResetToDefault() {
+	p.InitialDelay = 1 * time.Second
+	p.MaxDelay = 30 * time.Second
+	p.Multiplier = 2
+	p.Jitter = 0.2
+	p.MaxAttempts = 0
+}
+
+// Delay returns how long to wait before the given attempt, starting at 1.
+func (p ReconnectPolicy) Delay(attempt int) time.Duration {
+	delay := RetryPolicy{
+		InitialDelay: p.InitialDelay,
+		MaxDelay:     p.MaxDelay,
+		Multiplier:   p.Multiplier,
+	}.Delay(attempt)
+
+	if jitter := min(max(p.Jitter, 0), 1); jitter > 0 {
+		delay += time.Duration(float64(delay) * jitter * (2*rand.Float64() - 1))
+	}
+
+	return delay
+}
+
+type State int
+
+const (
+	// StateReconnecting is the state of a connection that is not established yet, or that was lost.
+	StateReconnecting State = iota
+	StateConnected
+	// StateClosed is final: the connection was closed, or gave up reconnecting.
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateReconnecting:
+		return "reconnecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
 func NewConnection(
 	url string,
 	logger xlog.Logger,
+	opts ...ConnectionOption,
 ) *Connection {
-	return &Connection{
+	c := &Connection{
 		url:    url,
 		logger: logger,
+		quit:   make(chan struct{}),
+	}
+	c.policy.ResetToDefault()
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+type ConnectionOption func(*Connection)
+
+// WithReconnectPolicy replaces the default policy, a policy without initial delay is ignored.
+func WithReconnectPolicy(policy ReconnectPolicy) ConnectionOption {
+	return func(c *Connection) {
+		if policy.InitialDelay > 0 {
+			c.policy = policy
+		}
 	}
 }
 
 type Connection struct {
-	url    string
-	conn   *amqp091.Connection
-	mutex  sync.Mutex
-	logger xlog.Logger
+	url       string
+	conn      *amqp091.Connection
+	mutex     sync.Mutex
+	logger    xlog.Logger
+	policy    ReconnectPolicy
+	state     State
+	listeners []chan State
+	quit      chan struct{}
 }
 
 // Connect establishes the connection to RabbitMQ
@@ -33,6 +121,10 @@ func (c *Connection) Connect() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	if c.state == StateClosed {
+		return ErrConnectionClosed
+	}
+
 	if c.conn != nil && !c.conn.IsClosed() {
 		c.logger.Debug("rabbitmq connection already established")
 		return nil
@@ -44,33 +136,129 @@ func (c *Connection) Connect() error {
 	if err != nil {
 		return fmt.Errorf("failed to dial server: %w", err)
 	}
+
+	// registered before the connection can be used, so that its closure is never missed
+	closed := conn.NotifyClose(make(chan *amqp091.Error, 1))
 	c.conn = conn
+	c.setState(StateConnected)
 
-	go c.monitorConnection()
+	go c.monitorConnection(closed)
 	return nil
 }
 
 // monitorConnection watches for connection closure and reconnects
-func (c *Connection) monitorConnection() {
-	errChan := make(chan *amqp091.Error)
-	c.conn.NotifyClose(errChan)
-	err := <-errChan
-	if err != nil {
-		c.logger.Info("rabbitmq connection closed", lf.Err(err))
-		c.mutex.Lock()
-		c.conn = nil
+func (c *Connection) monitorConnection(closed <-chan *amqp091.Error) {
+	// the error is nil when the connection was already closed, which tells nothing about the reason:
+	// only Close closes it on purpose
+	err := <-closed
+
+	c.mutex.Lock()
+	if c.state == StateClosed {
 		c.mutex.Unlock()
-		// Attempt to reconnect
-		for {
-			time.Sleep(5 * time.Second)
-			if err := c.Connect(); err == nil {
-				c.logger.Info("reconnected to rabbitmq")
-				break
-			}
-
-			c.logger.Warning("failed to reconnect to rabbitmq", lf.String("url", c.url), lf.Err(err))
+		return
+	}
+	c.logger.Info("rabbitmq connection closed", lf.Err(err))
+	c.conn = nil
+	c.setState(StateReconnecting)
+	c.mutex.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		if c.policy.MaxAttempts > 0 && attempt > c.policy.MaxAttempts {
+			c.logger.Error("gave up reconnecting to rabbitmq", lf.String("url", c.url), lf.Int("attempts", c.policy.MaxAttempts))
+			_ = c.Close()
+			return
+		}
+
+		timer := time.NewTimer(c.policy.Delay(attempt))
+		select {
+		case <-c.quit:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := c.Connect()
+		if err == nil {
+			c.logger.Info("reconnected to rabbitmq", lf.Int("attempt", attempt))
+			return
+		}
+
+		if errors.Is(err, ErrConnectionClosed) {
+			return
+		}
+
+		c.logger.Warning("failed to reconnect to rabbitmq", lf.String("url", c.url), lf.Int("attempt", attempt), lf.Err(err))
+	}
+}
+
+// setState must be called with the mutex held.
+func (c *Connection) setState(state State) {
+	if c.state == state {
+		return
+	}
+	c.state = state
+
+	for _, listener := range c.listeners {
+		select {
+		case listener <- state:
+		default:
 		}
 	}
+
+	if state == StateClosed {
+		for _, listener := range c.listeners {
+			close(listener)
+		}
+		c.listeners = nil
+	}
+}
+
+// State returns the current state of the connection.
+func (c *Connection) State() State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state
+}
+
+// NotifyState registers a channel receiving the state of the connection every time it changes,
+// and returns it. The channel is closed once the connection is closed.
+//
+// Notifications are dropped when the channel is full rather than blocking the connection,
+// so it should be buffered, and State remains the reference.
+func (c *Connection) NotifyState(listener chan State) chan State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == StateClosed {
+		close(listener)
+		return listener
+	}
+
+	c.listeners = append(c.listeners, listener)
+	return listener
+}
+
+// Close closes the connection and stops reconnecting. Using it afterward fails with ErrConnectionClosed.
+func (c *Connection) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == StateClosed {
+		return nil
+	}
+
+	close(c.quit)
+	c.setState(StateClosed)
+
+	conn := c.conn
+	c.conn = nil
+	if conn != nil && !conn.IsClosed() {
+		if err := conn.Close(); err != nil {
+			return fmt.Errorf("failed to close connection: %w", err)
+		}
+	}
+
+	return nil
 }
 
 // GetChannel returns a new channel from the connection
@@ -78,7 +266,7 @@ func (c *Connection) GetChannel() (*amqp091.Channel, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	if c.conn == nil || c.conn.IsClosed() {
-		return nil, errors.New("connection is closed")
+		return nil, ErrConnectionClosed
 	}
 	return c.conn.Channel()
 }
@@ -0,0 +1,306 @@
+package xrabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/raphoester/x/xerrs"
+	"github.com/raphoester/x/xlog"
+	"github.com/raphoester/x/xlog/lf"
+)
+
+type ConsumerStatus string
+
+const (
+	ConsumerStarting   ConsumerStatus = "starting"
+	ConsumerConsuming  ConsumerStatus = "consuming"
+	ConsumerRestarting ConsumerStatus = "restarting"
+	ConsumerStopped    ConsumerStatus = "stopped"
+	// ConsumerFailed is final: the consumer met an error that restarting can't fix, see Stream.Err.
+	ConsumerFailed ConsumerStatus = "failed"
+)
+
+// ConsumerHealth describes one of the consumers of a stream.
+type ConsumerHealth struct {
+	Queue  string
+	Status ConsumerStatus
+	// Restarts counts the times the consumer was set up again after losing its channel.
+	Restarts  int
+	LastError error
+	Since     time.Time
+}
+
+const defaultRestartDelay = time.Second
+
+// consumer consumes a single queue, setting its channel up again whenever it is lost.
+//
+// Deliveries are handled one at a time, so once supervise returned, no callback is running anymore.
+type consumer struct {
+	ctx         context.Context
+	connection  *Connection
+	identifier  int
+	queue       string
+	source      string
+	routingKeys []string
+	exchange    string
+	options     StreamOptions
+	callback    func(context.Context, amqp091.Delivery) error
+	retryPolicy RetryPolicy
+	delay       time.Duration
+	logger      xlog.Logger
+
+	stop      <-chan struct{}
+	ready     chan error
+	readyOnce sync.Once
+
+	mu     sync.Mutex
+	health ConsumerHealth
+
+	// next is the offset to resume reading a stream queue at, and committed the last one saved,
+	// both -1 until known
+	next      int64
+	committed int64
+}
+
+// supervise runs the consumer until it is stopped, or until it failed for good, in which case the error is returned.
+func (c *consumer) supervise() error {
+	c.setHealth(ConsumerStarting, nil)
+
+	for {
+		stopped, err := c.consume()
+		if stopped {
+			c.setHealth(ConsumerStopped, nil)
+			c.signalReady(nil)
+			return nil
+		}
+
+		if isPermanentConsumerError(err) || c.connection.State() == StateClosed {
+			err = xerrs.Permanent(fmt.Errorf("consumer %d of queue %q failed: %w", c.identifier, c.queue, err))
+			c.logger.Error("consumer failed", c.fields(lf.Err(err))...)
+			c.setHealth(ConsumerFailed, err)
+			c.signalReady(err)
+			return err
+		}
+
+		c.logger.Warning("consumer lost its channel, restarting", c.fields(lf.Err(err))...)
+		c.setHealth(ConsumerRestarting, err)
+
+		timer := time.NewTimer(c.delay)
+		select {
+		case <-c.stop:
+			timer.Stop()
+			c.setHealth(ConsumerStopped, nil)
+			c.signalReady(nil)
+			return nil
+		case <-timer.C:
+		}
+
+		c.mu.Lock()
+		c.health.Restarts++
+		c.mu.Unlock()
+	}
+}
+
+// consume sets a channel up and handles its deliveries until it is lost or the consumer is stopped.
+func (c *consumer) consume() (bool, error) {
+	select {
+	case <-c.stop:
+		return true, nil
+	default:
+	}
+
+	ch, err := c.connection.GetChannel()
+	if err != nil {
+		return false, fmt.Errorf("failed to get channel: %w", err)
+	}
+	defer func() { _ = ch.Close() }()
+
+	closed := ch.NotifyClose(make(chan *amqp091.Error, 1))
+
+	msgs, err := c.setup(ch)
+	if err != nil {
+		return false, err
+	}
+
+	c.setHealth(ConsumerConsuming, nil)
+	c.signalReady(nil)
+
+	for {
+		// stopping has precedence over the deliveries already waiting, which are given back to the queue
+		select {
+		case <-c.stop:
+			return true, nil
+		default:
+		}
+
+		select {
+		case <-c.stop:
+			return true, nil
+		case msg, ok := <-msgs:
+			if !ok {
+				// the reason of an abnormal closure is sent before the deliveries channel is closed
+				select {
+				case reason, ok := <-closed:
+					if ok && reason != nil {
+						return false, fmt.Errorf("channel closed: %w", reason)
+					}
+				default:
+				}
+
+				return false, errors.New("deliveries channel closed")
+			}
+
+			c.logger.Debug("received delivery", c.fields(
+				lf.String("routing_key", msg.RoutingKey),
+				lf.String("message_id", msg.MessageId),
+			)...)
+
+			if c.options.Queue.Stream {
+				if err := c.handleStreamDelivery(ch, msg); errors.Is(err, errConsumerStopped) {
+					return true, nil
+				} else if err != nil {
+					return false, err
+				}
+				continue
+			}
+
+			handleMessageWithAck(c.ctx, ch, msg, c.exchange, c.queue, c.retryPolicy, c.callback, c.logger)
+		}
+	}
+}
+
+// setup declares and binds the queue, then starts consuming it.
+func (c *consumer) setup(ch *amqp091.Channel) (<-chan amqp091.Delivery, error) {
+	if _, err := ch.QueueDeclare(
+		c.queue,
+		c.options.Queue.durable(),
+		c.options.Queue.AutoDelete,
+		c.options.Queue.Exclusive,
+		false,
+		c.options.Queue.arguments(),
+	); err != nil {
+		return nil, fmt.Errorf("failed to declare queue: %w", err)
+	}
+
+	prefetch := c.options.Prefetch
+	if c.options.Queue.Stream && prefetch <= 0 {
+		prefetch = defaultStreamPrefetch
+	}
+
+	if prefetch > 0 {
+		if err := ch.Qos(prefetch, 0, false); err != nil {
+			return nil, fmt.Errorf("failed to set prefetch count: %w", err)
+		}
+	}
+
+	// failed deliveries of a stream are retried in place, only the dead-letter queue is needed
+	if c.options.Queue.Stream {
+		if !c.options.SkipFailures {
+			if err := declareDeadLetterQueue(ch, c.exchange, c.queue); err != nil {
+				return nil, err
+			}
+		}
+	} else if c.retryPolicy.Enabled() {
+		if err := declareRetryTopology(ch, c.exchange, c.queue, c.retryPolicy); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, routingKey := range c.routingKeys {
+		if err := ch.QueueBind(
+			c.queue,
+			routingKey,
+			c.source,
+			false,
+			nil,
+		); err != nil {
+			return nil, fmt.Errorf("failed to bind queue on routing key %q: %w", routingKey, err)
+		}
+	}
+
+	var args amqp091.Table
+	if c.options.Queue.Stream {
+		if c.options.OffsetTracking != "" && c.next < 0 {
+			offset, ok, err := c.loadOffset(ch)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				c.next, c.committed = offset, offset
+			}
+		}
+
+		args = amqp091.Table{HeaderStreamOffset: c.streamOffset()}
+	}
+
+	msgs, err := ch.Consume(
+		c.queue,
+		"",
+		false,
+		false,
+		false,
+		false,
+		args,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume: %w", err)
+	}
+
+	return msgs, nil
+}
+
+// signalReady reports the outcome of the first setup, later ones come from restarts.
+func (c *consumer) signalReady(err error) {
+	c.readyOnce.Do(func() {
+		c.ready <- err
+	})
+}
+
+func (c *consumer) setHealth(status ConsumerStatus, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.health.Queue = c.queue
+	c.health.Status = status
+	c.health.Since = time.Now()
+	if err != nil {
+		c.health.LastError = err
+	}
+}
+
+func (c *consumer) Health() ConsumerHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.health
+}
+
+func (c *consumer) fields(fields ...lf.Field) []lf.Field {
+	return append([]lf.Field{
+		lf.Int("identifier", c.identifier),
+		lf.String("queue_name", c.queue),
+	}, fields...)
+}
+
+// isPermanentConsumerError tells whether the error can't be fixed by setting the consumer up again,
+// like declaring a queue that exists with other arguments.
+func isPermanentConsumerError(err error) bool {
+	if xerrs.IsPermanent(err) {
+		return true
+	}
+
+	var amqpErr *amqp091.Error
+	if !errors.As(err, &amqpErr) {
+		return false
+	}
+
+	switch amqpErr.Code {
+	case amqp091.AccessRefused, amqp091.PreconditionFailed, amqp091.NotAllowed, amqp091.NotImplemented:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,161 @@
+package xrabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/raphoester/x/xerrs"
+	"github.com/raphoester/x/xlog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConsumer(connection *Connection, stop chan struct{}) *consumer {
+	return &consumer{
+		ctx:        context.Background(),
+		connection: connection,
+		queue:      "queue",
+		callback:   func(context.Context, amqp091.Delivery) error { return nil },
+		delay:      time.Millisecond,
+		logger:     xlog.NopLogger{},
+		stop:       stop,
+		ready:      make(chan error, 1),
+	}
+}
+
+func TestConsumerRestartsUntilStopped(t *testing.T) {
+	stop := make(chan struct{})
+	c := newTestConsumer(NewConnection("amqp://localhost:1/", xlog.NopLogger{}), stop)
+
+	done := make(chan error)
+	go func() { done <- c.supervise() }()
+
+	require.Eventually(t, func() bool { return c.Health().Restarts >= 3 }, time.Second, time.Millisecond)
+	health := c.Health()
+	assert.Equal(t, ConsumerRestarting, health.Status)
+	assert.ErrorIs(t, health.LastError, ErrConnectionClosed)
+
+	close(stop)
+	require.NoError(t, <-done)
+	assert.Equal(t, ConsumerStopped, c.Health().Status)
+	assert.NoError(t, <-c.ready, "a consumer stopped before being ready is not a failure")
+}
+
+func TestConsumerFailsOnceConnectionIsClosed(t *testing.T) {
+	connection := NewConnection("amqp://localhost:1/", xlog.NopLogger{})
+	require.NoError(t, connection.Close())
+
+	c := newTestConsumer(connection, make(chan struct{}))
+	err := c.supervise()
+
+	assert.ErrorIs(t, err, ErrConnectionClosed)
+	assert.True(t, xerrs.IsPermanent(err))
+	assert.Equal(t, ConsumerFailed, c.Health().Status)
+	assert.Equal(t, err, <-c.ready)
+}
+
+func TestIsPermanentConsumerError(t *testing.T) {
+	assert.True(t, isPermanentConsumerError(fmt.Errorf("failed to declare queue: %w", &amqp091.Error{Code: amqp091.PreconditionFailed})))
+	assert.True(t, isPermanentConsumerError(&amqp091.Error{Code: amqp091.AccessRefused}))
+	assert.False(t, isPermanentConsumerError(&amqp091.Error{Code: amqp091.ChannelError}))
+	assert.False(t, isPermanentConsumerError(errors.New("deliveries channel closed")))
+}
+
+type acknowledger struct {
+	acked int
+}
+
+func (a *acknowledger) Ack(uint64, bool) error        { a.acked++; return nil }
+func (a *acknowledger) Nack(uint64, bool, bool) error { return nil }
+func (a *acknowledger) Reject(uint64, bool) error     { return nil }
+
+func TestConsumerHandleStreamDelivery(t *testing.T) {
+	stop := make(chan struct{})
+	c := newTestConsumer(nil, stop)
+	c.options.Queue.Stream = true
+	c.next = -1
+
+	ack := &acknowledger{}
+	delivery := func(offset int64) amqp091.Delivery {
+		return amqp091.Delivery{Acknowledger: ack, Headers: amqp091.Table{HeaderStreamOffset: offset}}
+	}
+
+	require.NoError(t, c.handleStreamDelivery(nil, delivery(4)))
+	assert.Equal(t, int64(5), c.next)
+	assert.Equal(t, 1, ack.acked)
+
+	// failures are retried in place, with the attempt in the headers
+	attempts := make([]int, 0)
+	c.callback = func(_ context.Context, delivery amqp091.Delivery) error {
+		attempts = append(attempts, DeliveryAttempt(delivery))
+		if len(attempts) < 3 {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	c.retryPolicy = RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond}
+	require.NoError(t, c.handleStreamDelivery(nil, delivery(5)))
+	assert.Equal(t, []int{1, 2, 3}, attempts)
+	assert.Equal(t, int64(6), c.next)
+	assert.Equal(t, 2, ack.acked)
+
+	// without retry policy, a delivery is attempted once, then skipped if the stream skips failures
+	c.retryPolicy = RetryPolicy{}
+	c.options.SkipFailures = true
+	attempts = attempts[:0]
+	c.callback = func(_ context.Context, delivery amqp091.Delivery) error {
+		attempts = append(attempts, DeliveryAttempt(delivery))
+		return errors.New("failed")
+	}
+	require.NoError(t, c.handleStreamDelivery(nil, delivery(6)))
+	assert.Equal(t, []int{1}, attempts)
+	assert.Equal(t, int64(7), c.next)
+	assert.Equal(t, 3, ack.acked)
+
+	// stopping while waiting for the next attempt reads the stream again from the failed delivery
+	c.retryPolicy = RetryPolicy{MaxAttempts: 3, InitialDelay: time.Hour}
+	close(stop)
+	assert.ErrorIs(t, c.handleStreamDelivery(nil, delivery(7)), errConsumerStopped)
+	assert.Equal(t, int64(7), c.streamOffset())
+	assert.Equal(t, 3, ack.acked)
+}
+
+func TestStreamOptionsValidation(t *testing.T) {
+	stream := QueueOptions{Stream: true}
+
+	assert.NoError(t, StreamOptions{Consumers: 1, Queue: stream, Offset: OffsetFirst(), OffsetTracking: "name"}.validate())
+	assert.Error(t, StreamOptions{Consumers: 2, Queue: stream}.validate())
+	assert.Error(t, StreamOptions{Partitions: 4, Queue: stream}.validate())
+	assert.Error(t, StreamOptions{Queue: QueueOptions{Stream: true, Quorum: true}}.validate())
+	assert.Error(t, StreamOptions{Queue: QueueOptions{Stream: true, MaxLength: 10}}.validate())
+	assert.Error(t, StreamOptions{Queue: QueueOptions{MaxAge: time.Hour}}.validate())
+	assert.Error(t, StreamOptions{Offset: OffsetLast()}.validate())
+	assert.Error(t, StreamOptions{OffsetTracking: "name"}.validate())
+	assert.Error(t, StreamOptions{SkipFailures: true}.validate())
+
+	args := QueueOptions{Stream: true, MaxAge: 24 * time.Hour}.arguments()
+	assert.Equal(t, "stream", args["x-queue-type"])
+	assert.Equal(t, "86400s", args["x-max-age"])
+	assert.True(t, stream.durable())
+}
+
+func TestOffsetArgument(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, "next", Offset{}.argument())
+	assert.Equal(t, "first", OffsetFirst().argument())
+	assert.Equal(t, "last", OffsetLast().argument())
+	assert.Equal(t, int64(42), OffsetAt(42).argument())
+	assert.Equal(t, at, OffsetFrom(at).argument())
+
+	offset, ok := DeliveryOffset(amqp091.Delivery{Headers: amqp091.Table{HeaderStreamOffset: int64(7)}})
+	assert.True(t, ok)
+	assert.Equal(t, int64(7), offset)
+
+	_, ok = DeliveryOffset(amqp091.Delivery{})
+	assert.False(t, ok)
+}
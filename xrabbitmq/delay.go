@@ -0,0 +1,127 @@
+package xrabbitmq
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// delayExpiry is how long a delay queue is kept once nothing was published to it,
+// on top of its TTL so that its messages are always dead-lettered before it is deleted.
+const delayExpiry = time.Minute
+
+// delayRedeclareInterval is how long a delay is known to be declared, it must be shorter than delayExpiry
+// so that the queue is declared again, which resets its expiry, before the messages published since can expire.
+const delayRedeclareInterval = delayExpiry / 2
+
+func delayName(exchange string, delay time.Duration) string {
+	return exchange + ".delay." + strconv.FormatInt(delay.Milliseconds(), 10)
+}
+
+// PublishAt publishes the message so that it reaches the exchange at the given time.
+//
+// The message waits in a queue whose TTL is the delay, rounded up to the delay precision (see Config),
+// then is dead-lettered to the exchange with its topic. There is a queue per delay, deleted once unused.
+// The expiration of the payload, if any, applies while waiting as well.
+//
+// It goes through the publish buffer and waits for publisher confirms like Publish, the delay being computed
+// again when a buffered message is flushed. The message always reaches the delay queue: it can only be
+// told unroutable by Mandatory once dead-lettered, and is then dropped by the broker.
+func (c *Client) PublishAt(ctx context.Context, payload Payload, at time.Time) error {
+	if !at.After(time.Now()) {
+		return c.Publish(ctx, payload)
+	}
+
+	return c.publishMessage(ctx, outgoingMessage{Payload: payload, DeliverAt: at})
+}
+
+// PublishAfter publishes the message so that it reaches the exchange once the delay is over, see PublishAt.
+func (c *Client) PublishAfter(ctx context.Context, payload Payload, delay time.Duration) error {
+	return c.PublishAt(ctx, payload, time.Now().Add(delay))
+}
+
+// PublishBatchAfter publishes the payloads like PublishBatch, so that they reach the exchange once the delay is over.
+// See PublishAt for how messages are delayed.
+func (c *Client) PublishBatchAfter(ctx context.Context, delay time.Duration, payloads ...Payload) error {
+	if delay <= 0 {
+		return c.PublishBatch(ctx, payloads...)
+	}
+
+	return c.withDelay(delay, func(exchange string) error {
+		return c.publishBatch(ctx, exchange, payloads...)
+	})
+}
+
+// publishDelayed publishes the message to the delay exchange, declaring it if needed.
+func (c *Client) publishDelayed(ctx context.Context, payload Payload, delay time.Duration) error {
+	return c.withDelay(delay, func(exchange string) error {
+		return c.publish(ctx, exchange, payload)
+	})
+}
+
+// withDelay declares the delay, rounded up to the delay precision, and publishes to its exchange.
+func (c *Client) withDelay(delay time.Duration, publish func(exchange string) error) error {
+	if c.delayPrecision > 0 {
+		delay = (delay + c.delayPrecision - 1) / c.delayPrecision * c.delayPrecision
+	}
+	delay = max(delay, time.Millisecond)
+
+	exchange, err := c.declareDelay(delay)
+	if err != nil {
+		return err
+	}
+
+	if err := publish(exchange); err != nil {
+		// the exchange may be gone along with its queue, declare them again next time
+		c.delaysMutex.Lock()
+		delete(c.delays, delay)
+		c.delaysMutex.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// declareDelay declares the fanout exchange and the queue messages wait in for the delay, and returns the exchange.
+//
+// They are declared again once in a while as long as the delay is used, which keeps the queue from expiring
+// while messages are waiting in it.
+func (c *Client) declareDelay(delay time.Duration) (string, error) {
+	name := delayName(c.exchange, delay)
+
+	c.delaysMutex.Lock()
+	defer c.delaysMutex.Unlock()
+
+	if declaredAt, ok := c.delays[delay]; ok && time.Since(declaredAt) < delayRedeclareInterval {
+		return name, nil
+	}
+
+	ch, err := c.connection.GetChannel()
+	if err != nil {
+		return "", fmt.Errorf("failed to get channel: %w", err)
+	}
+	defer func() { _ = ch.Close() }()
+
+	// auto-deleted along with the binding of its queue
+	if err := ch.ExchangeDeclare(name, amqp091.ExchangeFanout, true, true, false, false, nil); err != nil {
+		return "", fmt.Errorf("failed to declare delay exchange: %w", err)
+	}
+
+	if _, err := ch.QueueDeclare(name, true, false, false, false, amqp091.Table{
+		"x-message-ttl":          delay.Milliseconds(),
+		"x-expires":              (delay + delayExpiry).Milliseconds(),
+		"x-dead-letter-exchange": c.exchange,
+	}); err != nil {
+		return "", fmt.Errorf("failed to declare delay queue: %w", err)
+	}
+
+	if err := ch.QueueBind(name, "", name, false, nil); err != nil {
+		return "", fmt.Errorf("failed to bind delay queue: %w", err)
+	}
+
+	c.delays[delay] = time.Now()
+	return name, nil
+}
@@ -0,0 +1,222 @@
+package xrabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/raphoester/x/xerrs"
+	"github.com/raphoester/x/xlog/lf"
+)
+
+// HeaderStreamOffset is the header holding the offset of the messages delivered from a stream queue.
+const HeaderStreamOffset = "x-stream-offset"
+
+// streams require a prefetch count, this is the one used when none was given
+const defaultStreamPrefetch = 100
+
+// Offset is a position in a stream queue, see StreamOptions.
+type Offset struct {
+	value any
+}
+
+// OffsetFirst is the first message still kept in the stream.
+func OffsetFirst() Offset {
+	return Offset{value: "first"}
+}
+
+// OffsetLast is the last chunk of messages written to the stream, so a few of the latest messages.
+func OffsetLast() Offset {
+	return Offset{value: "last"}
+}
+
+// OffsetNext is the next message written to the stream, skipping all the existing ones.
+func OffsetNext() Offset {
+	return Offset{value: "next"}
+}
+
+// OffsetAt is the message with the given offset, as found in the HeaderStreamOffset header.
+func OffsetAt(offset int64) Offset {
+	return Offset{value: max(offset, 0)}
+}
+
+// OffsetFrom is the first message written at the given time, to the second.
+func OffsetFrom(t time.Time) Offset {
+	return Offset{value: t}
+}
+
+func (o Offset) argument() any {
+	if o.value == nil {
+		return OffsetNext().value
+	}
+	return o.value
+}
+
+// DeliveryOffset returns the offset of a delivery from a stream queue.
+func DeliveryOffset(delivery amqp091.Delivery) (int64, bool) {
+	switch offset := delivery.Headers[HeaderStreamOffset].(type) {
+	case int64:
+		return offset, true
+	case int32:
+		return int64(offset), true
+	case int:
+		return int64(offset), true
+	default:
+		return 0, false
+	}
+}
+
+func offsetQueueName(queue string, name string) string {
+	return queue + ".offsets." + name
+}
+
+// loadOffset reads the offset saved by the consumer, and tells whether there was one.
+//
+// The server-side offset tracking of RabbitMQ is only available to the stream protocol, not to AMQP 0.9.1.
+// The offsets are thus kept in a queue holding only the last one, which stays there once read.
+func (c *consumer) loadOffset(ch *amqp091.Channel) (int64, bool, error) {
+	name := offsetQueueName(c.queue, c.options.OffsetTracking)
+	if _, err := ch.QueueDeclare(
+		name,
+		true,
+		false,
+		false,
+		false,
+		amqp091.Table{"x-max-length": 1},
+	); err != nil {
+		return 0, false, fmt.Errorf("failed to declare offsets queue: %w", err)
+	}
+
+	msg, ok, err := ch.Get(name, false)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get saved offset: %w", err)
+	}
+	if !ok {
+		return 0, false, nil
+	}
+
+	if err := msg.Reject(true); err != nil {
+		return 0, false, fmt.Errorf("failed to give saved offset back: %w", err)
+	}
+
+	offset, err := strconv.ParseInt(string(msg.Body), 10, 64)
+	if err != nil {
+		return 0, false, xerrs.Permanent(fmt.Errorf("failed to parse saved offset %q: %w", msg.Body, err))
+	}
+
+	return offset, true, nil
+}
+
+// commitOffset saves the offset the consumer resumes at, if it moved since last time.
+//
+// It is called once each delivery is handled, before the next one is: a delivery is only handled again if the
+// consumer stops between its callback returning and its offset being saved, or if saving it failed.
+func (c *consumer) commitOffset(ch *amqp091.Channel) {
+	if c.options.OffsetTracking == "" || c.next < 0 || c.next == c.committed || ch.IsClosed() {
+		return
+	}
+
+	if err := ch.PublishWithContext(
+		context.WithoutCancel(c.ctx),
+		"",
+		offsetQueueName(c.queue, c.options.OffsetTracking),
+		false,
+		false,
+		amqp091.Publishing{
+			DeliveryMode: amqp091.Persistent,
+			Body:         []byte(strconv.FormatInt(c.next, 10)),
+		},
+	); err != nil {
+		c.logger.Warning("failed to commit stream offset", c.fields(lf.Err(err))...)
+		return
+	}
+
+	c.committed = c.next
+}
+
+// streamOffset is the position the consumer starts reading the stream at.
+func (c *consumer) streamOffset() any {
+	if c.next >= 0 {
+		return c.next
+	}
+	return c.options.Offset.argument()
+}
+
+// errConsumerStopped interrupts the handling of a delivery when the consumer is stopped.
+var errConsumerStopped = errors.New("consumer stopped")
+
+// handleStreamDelivery runs the callback on a delivery of a stream queue. Messages stay in a stream once acked,
+// so failed deliveries are retried in place as told by the retry policy, and only attempted once without one.
+//
+// Once the attempts are exhausted, or on a permanent failure, the delivery is moved to the dead-letter queue,
+// or skipped if the stream skips failures (see StreamOptions.SkipFailures). It returns errConsumerStopped when
+// the consumer was stopped before the delivery could be handled, the stream being read again from it on the next start.
+func (c *consumer) handleStreamDelivery(ch *amqp091.Channel, msg amqp091.Delivery) error {
+	offset, hasOffset := DeliveryOffset(msg)
+	maxAttempts := 1
+	if c.retryPolicy.Enabled() {
+		maxAttempts = c.retryPolicy.MaxAttempts
+	}
+
+	fields := c.fields(
+		lf.String("message_id", msg.MessageId),
+		lf.String("routing_key", msg.RoutingKey),
+		lf.Int("offset", int(offset)),
+	)
+
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		msg.Headers = copyHeaders(msg.Headers)
+		msg.Headers[HeaderAttempt] = int32(attempt)
+
+		err = runCallback(c.ctx, msg, c.callback, c.logger, append(fields, lf.Int("attempt", attempt)))
+		if err == nil || xerrs.IsPermanent(err) || attempt >= maxAttempts {
+			break
+		}
+
+		c.logger.Warning("failed to treat delivery, retrying", append(fields, lf.Int("attempt", attempt), lf.Err(err))...)
+
+		timer := time.NewTimer(c.retryPolicy.Delay(attempt))
+		select {
+		case <-c.stop:
+			timer.Stop()
+			if hasOffset {
+				c.next = offset
+			}
+			return errConsumerStopped
+		case <-timer.C:
+		}
+	}
+
+	if err != nil {
+		failure := append(fields, lf.Int("attempt", attempt), lf.Bool("permanent", xerrs.IsPermanent(err)), lf.Err(err))
+		if c.options.SkipFailures {
+			c.logger.Error("failed to treat delivery, skipping it", failure...)
+		} else {
+			// the offset is meaningless once out of the stream
+			delete(msg.Headers, HeaderStreamOffset)
+			if err := deadLetter(context.WithoutCancel(c.ctx), ch, c.exchange, c.queue, msg, err); err != nil {
+				if hasOffset {
+					c.next = offset
+				}
+				return fmt.Errorf("failed to move delivery at offset %d to dead-letter queue: %w", offset, err)
+			}
+			c.logger.Warning("moved delivery to dead-letter queue", failure...)
+		}
+	}
+
+	if err := msg.Ack(false); err != nil {
+		c.logger.Warning("failed to ack message", append(fields, lf.Err(err))...)
+	}
+
+	if hasOffset {
+		c.next = offset + 1
+		c.commitOffset(ch)
+	}
+
+	return nil
+}
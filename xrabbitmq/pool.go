@@ -0,0 +1,157 @@
+package xrabbitmq
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// publishChannel is a channel of the pool, along with the state of its confirm mode.
+type publishChannel struct {
+	ch       *amqp091.Channel
+	returns  <-chan amqp091.Return
+	returned map[string]amqp091.Return
+}
+
+// takeReturn tells whether the message was returned by the broker.
+func (pc *publishChannel) takeReturn(messageID string) (amqp091.Return, bool) {
+	if pc.returns == nil {
+		return amqp091.Return{}, false
+	}
+
+	pc.drainReturns()
+
+	returned, ok := pc.returned[messageID]
+	delete(pc.returned, messageID)
+	return returned, ok
+}
+
+// clearReturns forgets the returned messages no publisher waited for.
+func (pc *publishChannel) clearReturns() {
+	if pc.returns == nil {
+		return
+	}
+
+	pc.drainReturns()
+	clear(pc.returned)
+}
+
+func (pc *publishChannel) drainReturns() {
+	for {
+		select {
+		case returned, ok := <-pc.returns:
+			if !ok {
+				return
+			}
+			pc.returned[returned.MessageId] = returned
+		default:
+			return
+		}
+	}
+}
+
+// channelPool lends publish channels, each being used by a single publisher at a time.
+//
+// It opens up to size channels, lazily, and replaces the ones found closed.
+type channelPool struct {
+	connection *Connection
+	confirms   bool
+	mandatory  bool
+	idle       chan *publishChannel
+	slots      chan struct{}
+}
+
+func newChannelPool(connection *Connection, size int, confirms bool, mandatory bool) *channelPool {
+	size = max(size, 1)
+	return &channelPool{
+		connection: connection,
+		confirms:   confirms,
+		mandatory:  mandatory,
+		idle:       make(chan *publishChannel, size),
+		slots:      make(chan struct{}, size),
+	}
+}
+
+// acquire returns an open channel, waiting for one to be released if the pool is exhausted.
+func (p *channelPool) acquire(ctx context.Context) (*publishChannel, error) {
+	for {
+		select {
+		case pc := <-p.idle:
+			if pc.ch.IsClosed() {
+				p.discard(pc)
+				continue
+			}
+			return pc, nil
+		default:
+		}
+
+		select {
+		case pc := <-p.idle:
+			if pc.ch.IsClosed() {
+				p.discard(pc)
+				continue
+			}
+			return pc, nil
+		case p.slots <- struct{}{}:
+			pc, err := p.open()
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			return pc, nil
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to acquire publish channel: %w", ctx.Err())
+		}
+	}
+}
+
+func (p *channelPool) open() (*publishChannel, error) {
+	ch, err := p.connection.GetChannel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channel: %w", err)
+	}
+
+	pc := &publishChannel{ch: ch}
+	if !p.confirms {
+		return pc, nil
+	}
+
+	if err := ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, fmt.Errorf("failed to put channel in confirm mode: %w", err)
+	}
+
+	if p.mandatory {
+		pc.returns = ch.NotifyReturn(make(chan amqp091.Return, returnsBufferSize))
+		pc.returned = make(map[string]amqp091.Return)
+	}
+
+	return pc, nil
+}
+
+// release gives the channel back to the pool, or closes it if it can't be trusted anymore.
+func (p *channelPool) release(pc *publishChannel, broken bool) {
+	if broken || pc.ch.IsClosed() {
+		p.discard(pc)
+		return
+	}
+	p.idle <- pc
+}
+
+func (p *channelPool) discard(pc *publishChannel) {
+	_ = pc.ch.Close()
+	<-p.slots
+}
+
+// close closes the idle channels, the ones in use are closed along with the connection.
+func (p *channelPool) close() {
+	for {
+		select {
+		case pc := <-p.idle:
+			p.discard(pc)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package xrabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// QueueOptions are the properties of the queue declared by Stream.
+//
+// RabbitMQ refuses to declare an existing queue with different properties.
+type QueueOptions struct {
+	Durable    bool
+	Quorum     bool
+	Exclusive  bool
+	AutoDelete bool
+	MessageTTL time.Duration
+	MaxLength  int
+
+	// Stream declares a RabbitMQ stream: an append-only log whose messages are kept once consumed,
+	// so that consumers can read it again from any offset (see StreamOptions.Offset).
+	// Failed deliveries of a stream are retried in place, holding back the following ones until given up on,
+	// then dead-lettered (see StreamOptions.SkipFailures).
+	Stream bool
+	// MaxAge is how long the messages of a stream are kept, zero means forever.
+	MaxAge time.Duration
+}
+
+func (o QueueOptions) validate() error {
+	if o.Quorum && (o.Exclusive || o.AutoDelete) {
+		return errors.New("quorum queues can be neither exclusive nor auto-deleted")
+	}
+	if o.Stream && (o.Quorum || o.Exclusive || o.AutoDelete) {
+		return errors.New("streams can be neither quorum queues, exclusive nor auto-deleted")
+	}
+	if o.Stream && (o.MessageTTL > 0 || o.MaxLength > 0) {
+		return errors.New("streams support neither message TTL nor max length, use max age")
+	}
+	if !o.Stream && o.MaxAge > 0 {
+		return errors.New("max age only applies to streams")
+	}
+	return nil
+}
+
+func (o QueueOptions) durable() bool {
+	return o.Durable || o.Quorum || o.Stream
+}
+
+func (o QueueOptions) arguments() amqp091.Table {
+	args := amqp091.Table{}
+	if o.Quorum {
+		args["x-queue-type"] = "quorum"
+	}
+	if o.Stream {
+		args["x-queue-type"] = "stream"
+	}
+	if o.MaxAge > 0 {
+		args["x-max-age"] = fmt.Sprintf("%ds", max(int64(o.MaxAge.Seconds()), 1))
+	}
+	if o.MessageTTL > 0 {
+		args["x-message-ttl"] = o.MessageTTL.Milliseconds()
+	}
+	if o.MaxLength > 0 {
+		args["x-max-length"] = int64(o.MaxLength)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+type StreamOptions struct {
+	// Consumers is the number of consumers of the stream, each handling one delivery at a time. Defaults to 1.
+	Consumers int
+
+	// Prefetch is the number of unacknowledged deliveries each consumer can receive. Zero means no limit.
+	Prefetch int
+
+	// Partitions replaces the queue by as many queues named "<queue>.<n>", each with a single consumer,
+	// fed by a consistent hash exchange distributing the messages by their HeaderOrderingKey header.
+	// Messages sharing that header are thus handled one at a time, in publish order, unless they are retried.
+	// Retried and dead-lettered messages stay in their partition's own retry and dead-letter queues.
+	//
+	// Consumers is ignored when there are more than one partition.
+	Partitions int
+
+	Queue QueueOptions
+
+	// Offset is where the consumers of a stream queue start reading, defaults to the next message.
+	Offset Offset
+
+	// OffsetTracking names the position of the consumer in a stream queue, saved on RabbitMQ after each delivery
+	// in a queue named "<queue>.offsets.<name>". A consumer with the same name resumes right after the last message
+	// it handled, instead of at Offset. Deliveries are handled at least once: the last one is handled again if the
+	// consumer stopped before saving its offset.
+	OffsetTracking string
+
+	// SkipFailures makes a stream consumer log and skip the deliveries it gave up on,
+	// instead of moving them to the dead-letter queue.
+	SkipFailures bool
+}
+
+func (o StreamOptions) validate() error {
+	if err := o.Queue.validate(); err != nil {
+		return fmt.Errorf("invalid queue options: %w", err)
+	}
+
+	if !o.Queue.Stream {
+		if o.Offset != (Offset{}) || o.OffsetTracking != "" {
+			return errors.New("offsets only apply to stream queues")
+		}
+		if o.SkipFailures {
+			return errors.New("skipping failures only applies to stream queues")
+		}
+		return nil
+	}
+
+	// every consumer of a stream reads all its messages
+	if o.Consumers > 1 || o.Partitions > 1 {
+		return errors.New("stream queues are read by a single consumer")
+	}
+
+	return nil
+}
+
+type StreamOption func(*StreamOptions)
+
+func WithConsumers(consumers int) StreamOption {
+	return func(o *StreamOptions) {
+		o.Consumers = consumers
+	}
+}
+
+func WithPrefetch(prefetch int) StreamOption {
+	return func(o *StreamOptions) {
+		o.Prefetch = prefetch
+	}
+}
+
+func WithPartitions(partitions int) StreamOption {
+	return func(o *StreamOptions) {
+		o.Partitions = partitions
+	}
+}
+
+func WithQueueOptions(queue QueueOptions) StreamOption {
+	return func(o *StreamOptions) {
+		o.Queue = queue
+	}
+}
+
+func WithOffset(offset Offset) StreamOption {
+	return func(o *StreamOptions) {
+		o.Offset = offset
+	}
+}
+
+func WithOffsetTracking(name string) StreamOption {
+	return func(o *StreamOptions) {
+		o.OffsetTracking = name
+	}
+}
+
+func WithSkipFailures() StreamOption {
+	return func(o *StreamOptions) {
+		o.SkipFailures = true
+	}
+}
+
+// HeaderOrderingKey is the header partitioned streams distribute the messages by, see StreamOptions.Partitions.
+const HeaderOrderingKey = "x-ordering-key"
+
+func partitionExchangeName(queue string) string {
+	return queue + ".partitions"
+}
+
+func partitionQueueName(queue string, partition int) string {
+	return fmt.Sprintf("%s.%d", queue, partition)
+}
+
+// declarePartitionExchange declares the consistent hash exchange dispatching the messages of a partitioned stream
+// to its queues, and binds it to the client's exchange with the routing keys.
+//
+// It requires the rabbitmq_consistent_hash_exchange plugin.
+func (c *Client) declarePartitionExchange(queue string, routingKeys []string, options QueueOptions) (string, error) {
+	ch, err := c.connection.GetChannel()
+	if err != nil {
+		return "", fmt.Errorf("failed to get channel: %w", err)
+	}
+	defer func() { _ = ch.Close() }()
+
+	name := partitionExchangeName(queue)
+	if err := ch.ExchangeDeclare(
+		name,
+		"x-consistent-hash",
+		options.durable(),
+		false,
+		false,
+		false,
+		amqp091.Table{"hash-header": HeaderOrderingKey},
+	); err != nil {
+		return "", fmt.Errorf("failed to declare partition exchange: %w", err)
+	}
+
+	for _, routingKey := range routingKeys {
+		if err := ch.ExchangeBind(name, routingKey, c.exchange, false, nil); err != nil {
+			return "", fmt.Errorf("failed to bind partition exchange on routing key %q: %w", routingKey, err)
+		}
+	}
+
+	return name, nil
+}
@@ -0,0 +1,305 @@
+package xrabbitmq
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// RetryPolicy tells what to do with deliveries whose callback failed.
+//
+// Failed deliveries are parked in a retry queue whose TTL is the delay of the attempt,
+// then dead-lettered back to the consumer's queue. Once MaxAttempts is reached, they are moved to
+// the consumer's dead-letter queue, where they can be inspected and re-driven (see DeadLetters and Redrive).
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a delivery is handled before being dead-lettered.
+	// Zero disables the policy: failed deliveries are requeued right away, forever.
+	MaxAttempts  int           `yaml:"max_attempts"`
+	InitialDelay time.Duration `yaml:"initial_delay"`
+	MaxDelay     time.Duration `yaml:"max_delay"`
+	Multiplier   float64       `yaml:"multiplier"`
+}
+
+// ResetToDefault disables the policy, setting MaxAttempts is enough to enable it with the default delays.
+func (p *RetryPolicy) ResetToDefault() {
+	p.MaxAttempts = 0
+	p.InitialDelay = 1 * time.Second
+	p.MaxDelay = 1 * time.Minute
+	p.Multiplier = 2
+}
+
+func (p RetryPolicy) Enabled() bool {
+	return p.MaxAttempts > 0
+}
+
+// Delay returns how long to wait before the attempt following the given one.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := time.Duration(float64(p.InitialDelay) * math.Pow(multiplier, float64(attempt-1)))
+	if p.MaxDelay > 0 && (delay > p.MaxDelay || delay < 0) {
+		delay = p.MaxDelay
+	}
+
+	return delay
+}
+
+const (
+	HeaderAttempt            = "x-attempt"
+	HeaderOriginalRoutingKey = "x-original-routing-key"
+	HeaderOriginalExchange   = "x-original-exchange"
+	HeaderLastError          = "x-last-error"
+	HeaderDeadLetteredAt     = "x-dead-lettered-at"
+)
+
+// DeliveryAttempt returns the number of the current handling attempt of the delivery, starting at 1.
+func DeliveryAttempt(delivery amqp091.Delivery) int {
+	switch v := delivery.Headers[HeaderAttempt].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 1
+	}
+}
+
+func deadLetterExchangeName(exchange string) string {
+	return exchange + ".dlx"
+}
+
+func deadLetterQueueName(queue string) string {
+	return queue + ".dlq"
+}
+
+func retryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%dms", queue, delay.Milliseconds())
+}
+
+// declareRetryTopology declares the dead-letter queue and the retry queues needed by the policy for the queue.
+func declareRetryTopology(ch *amqp091.Channel, exchange string, queue string, policy RetryPolicy) error {
+	if err := declareDeadLetterQueue(ch, exchange, queue); err != nil {
+		return err
+	}
+
+	for attempt := 1; attempt < policy.MaxAttempts; attempt++ {
+		delay := policy.Delay(attempt)
+		if _, err := ch.QueueDeclare(retryQueueName(queue, delay), true, false, false, false, amqp091.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		}); err != nil {
+			return fmt.Errorf("failed to declare retry queue for delay %s: %w", delay, err)
+		}
+	}
+
+	return nil
+}
+
+func declareDeadLetterQueue(ch *amqp091.Channel, exchange string, queue string) error {
+	if _, err := ch.QueueDeclare(deadLetterQueueName(queue), true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare dead-letter queue: %w", err)
+	}
+
+	if err := ch.QueueBind(deadLetterQueueName(queue), queue, deadLetterExchangeName(exchange), false, nil); err != nil {
+		return fmt.Errorf("failed to bind dead-letter queue: %w", err)
+	}
+
+	return nil
+}
+
+// restoreRoutingKey gives back its original routing key to a delivery that went through a retry queue.
+func restoreRoutingKey(delivery *amqp091.Delivery) {
+	if key, ok := delivery.Headers[HeaderOriginalRoutingKey].(string); ok {
+		delivery.RoutingKey = key
+	}
+	if exchange, ok := delivery.Headers[HeaderOriginalExchange].(string); ok {
+		delivery.Exchange = exchange
+	}
+}
+
+func republishing(delivery amqp091.Delivery, headers amqp091.Table) amqp091.Publishing {
+	return amqp091.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    amqp091.Persistent,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		Expiration:      delivery.Expiration,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		UserId:          delivery.UserId,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	}
+}
+
+func copyHeaders(headers amqp091.Table) amqp091.Table {
+	cp := make(amqp091.Table, len(headers)+4)
+	for k, v := range headers {
+		cp[k] = v
+	}
+	return cp
+}
+
+// scheduleRetry parks the delivery in the retry queue matching the delay of its attempt.
+func scheduleRetry(ctx context.Context, ch *amqp091.Channel, queue string, delivery amqp091.Delivery, policy RetryPolicy, cause error) error {
+	attempt := DeliveryAttempt(delivery)
+
+	headers := copyHeaders(delivery.Headers)
+	headers[HeaderAttempt] = int32(attempt + 1)
+	headers[HeaderOriginalRoutingKey] = delivery.RoutingKey
+	headers[HeaderOriginalExchange] = delivery.Exchange
+	headers[HeaderLastError] = cause.Error()
+
+	return ch.PublishWithContext(ctx, "", retryQueueName(queue, policy.Delay(attempt)), false, false, republishing(delivery, headers))
+}
+
+// deadLetter moves the delivery to the consumer's dead-letter queue.
+func deadLetter(ctx context.Context, ch *amqp091.Channel, exchange string, queue string, delivery amqp091.Delivery, cause error) error {
+	headers := copyHeaders(delivery.Headers)
+	headers[HeaderAttempt] = int32(DeliveryAttempt(delivery))
+	headers[HeaderOriginalRoutingKey] = delivery.RoutingKey
+	headers[HeaderOriginalExchange] = delivery.Exchange
+	headers[HeaderLastError] = cause.Error()
+	headers[HeaderDeadLetteredAt] = time.Now().UTC()
+
+	return ch.PublishWithContext(ctx, deadLetterExchangeName(exchange), queue, false, false, republishing(delivery, headers))
+}
+
+// DeadLetter is a delivery that exhausted its attempts.
+type DeadLetter struct {
+	MessageID      string
+	Queue          string
+	RoutingKey     string
+	Attempts       int
+	LastError      string
+	DeadLetteredAt time.Time
+	ContentType    string
+	Timestamp      time.Time
+	Headers        map[string]any
+	Body           []byte
+}
+
+func deadLetterFromDelivery(queue string, delivery amqp091.Delivery) DeadLetter {
+	restoreRoutingKey(&delivery)
+	lastError, _ := delivery.Headers[HeaderLastError].(string)
+	deadLetteredAt, _ := delivery.Headers[HeaderDeadLetteredAt].(time.Time)
+
+	return DeadLetter{
+		MessageID:      delivery.MessageId,
+		Queue:          queue,
+		RoutingKey:     delivery.RoutingKey,
+		Attempts:       DeliveryAttempt(delivery),
+		LastError:      lastError,
+		DeadLetteredAt: deadLetteredAt,
+		ContentType:    delivery.ContentType,
+		Timestamp:      delivery.Timestamp,
+		Headers:        delivery.Headers,
+		Body:           delivery.Body,
+	}
+}
+
+// browseDeadLetters goes through the messages of the queue's dead-letter queue without consuming them,
+// unless fn returns true, in which case the message is acknowledged.
+//
+// Messages that are not acknowledged go back to the dead-letter queue when the channel is closed.
+func (c *Client) browseDeadLetters(queue string, limit int, fn func(ch *amqp091.Channel, delivery amqp091.Delivery) (bool, error)) error {
+	ch, err := c.connection.GetChannel()
+	if err != nil {
+		return fmt.Errorf("failed to get channel: %w", err)
+	}
+	defer func() { _ = ch.Close() }()
+
+	dlq := deadLetterQueueName(queue)
+	state, err := ch.QueueDeclarePassive(dlq, true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to inspect dead-letter queue %q: %w", dlq, err)
+	}
+
+	count := state.Messages
+	if limit > 0 && limit < count {
+		count = limit
+	}
+
+	for range count {
+		delivery, ok, err := ch.Get(dlq, false)
+		if err != nil {
+			return fmt.Errorf("failed to get message from dead-letter queue %q: %w", dlq, err)
+		}
+		if !ok {
+			return nil
+		}
+
+		ack, err := fn(ch, delivery)
+		if err != nil {
+			return err
+		}
+
+		if ack {
+			if err := delivery.Ack(false); err != nil {
+				return fmt.Errorf("failed to ack dead-lettered message %q: %w", delivery.MessageId, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeadLetters lists up to limit messages of the queue's dead-letter queue, without removing them.
+// A limit of zero lists them all.
+func (c *Client) DeadLetters(_ context.Context, queue string, limit int) ([]DeadLetter, error) {
+	deadLetters := make([]DeadLetter, 0)
+	err := c.browseDeadLetters(queue, limit, func(_ *amqp091.Channel, delivery amqp091.Delivery) (bool, error) {
+		deadLetters = append(deadLetters, deadLetterFromDelivery(queue, delivery))
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deadLetters, nil
+}
+
+// Redrive publishes the dead-lettered messages of the queue back to the exchange under their original routing key,
+// with a fresh attempt count. Only the given message IDs are re-driven, or all of them if none is given.
+//
+// It returns the number of re-driven messages.
+func (c *Client) Redrive(ctx context.Context, queue string, messageIDs ...string) (int, error) {
+	redriven := 0
+	err := c.browseDeadLetters(queue, 0, func(ch *amqp091.Channel, delivery amqp091.Delivery) (bool, error) {
+		if len(messageIDs) > 0 && !slices.Contains(messageIDs, delivery.MessageId) {
+			return false, nil
+		}
+
+		restoreRoutingKey(&delivery)
+		headers := copyHeaders(delivery.Headers)
+		for _, key := range []string{HeaderAttempt, HeaderOriginalRoutingKey, HeaderOriginalExchange, HeaderLastError, HeaderDeadLetteredAt} {
+			delete(headers, key)
+		}
+
+		if err := ch.PublishWithContext(ctx, c.exchange, delivery.RoutingKey, false, false, republishing(delivery, headers)); err != nil {
+			return false, fmt.Errorf("failed to re-drive message %q: %w", delivery.MessageId, err)
+		}
+
+		redriven++
+		return true, nil
+	})
+	if err != nil {
+		return redriven, err
+	}
+
+	return redriven, nil
+}
@@ -0,0 +1,31 @@
+package xrabbitmq_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/raphoester/x/xrabbitmq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := xrabbitmq.RetryPolicy{}
+	policy.ResetToDefault()
+	assert.False(t, policy.Enabled(), "retries are opt-in")
+
+	assert.Equal(t, 1*time.Second, policy.Delay(1))
+	assert.Equal(t, 2*time.Second, policy.Delay(2))
+	assert.Equal(t, 16*time.Second, policy.Delay(5))
+	assert.Equal(t, 1*time.Minute, policy.Delay(10), "delay is capped")
+
+	policy.Multiplier = 0
+	assert.Equal(t, 1*time.Second, policy.Delay(4), "constant delay without multiplier")
+}
+
+func TestDeliveryAttempt(t *testing.T) {
+	assert.Equal(t, 1, xrabbitmq.DeliveryAttempt(amqp091.Delivery{}))
+	assert.Equal(t, 3, xrabbitmq.DeliveryAttempt(amqp091.Delivery{
+		Headers: amqp091.Table{xrabbitmq.HeaderAttempt: int32(3)},
+	}))
+}
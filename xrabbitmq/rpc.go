@@ -0,0 +1,277 @@
+package xrabbitmq
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/raphoester/x/xid"
+	"github.com/raphoester/x/xlog/lf"
+)
+
+const (
+	// HeaderDeadline carries the deadline of a request, in milliseconds since the epoch.
+	HeaderDeadline = "x-deadline"
+	// HeaderRemoteError carries the error returned by the handler of a request, in place of its reply.
+	HeaderRemoteError = "x-remote-error"
+)
+
+// directReplyTo is the pseudo-queue RabbitMQ routes replies through, straight to the channel of the requester.
+const directReplyTo = "amq.rabbitmq.reply-to"
+
+// RemoteError is the error returned by the handler serving a request.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote handler failed: " + e.Message
+}
+
+// RequestQueueName is the queue consumed by the servers of the topic, see Client.Serve.
+//
+// Requests are sent straight to it through the default exchange, so that they never mix with the events
+// published on the client's exchange.
+func RequestQueueName(topic string) string {
+	return "rpc." + topic
+}
+
+// Request sends the payload to the servers of the topic and waits for the reply of one of them (see Serve),
+// until the context is done. The topic of the payload is ignored.
+//
+// The request expires along with the context's deadline, so that servers never handle requests nobody waits for.
+// If no server listens to the topic, it fails right away with ErrUnroutable.
+func (c *Client) Request(ctx context.Context, topic string, payload Payload) (Payload, error) {
+	if payload.MessageID == "" {
+		payload.MessageID = xid.RandomGenerator{}.Generate()
+	}
+	payload.Topic = topic
+	payload.CorrelationID = payload.MessageID
+	payload.ReplyTo = directReplyTo
+	payload.Headers = maps.Clone(payload.Headers)
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if payload.Headers == nil {
+			payload.Headers = make(map[string]any, 1)
+		}
+		payload.Headers[HeaderDeadline] = deadline.UnixMilli()
+		payload.Expiration = max(time.Until(deadline), time.Millisecond)
+	}
+
+	publishing := payload.publishing()
+	publishing.DeliveryMode = amqp091.Transient
+
+	replies, err := c.requests.send(ctx, "", RequestQueueName(topic), publishing)
+	if err != nil {
+		return Payload{}, err
+	}
+
+	select {
+	case reply := <-replies:
+		if reply.err != nil {
+			return Payload{}, reply.err
+		}
+
+		if message, ok := reply.delivery.Headers[HeaderRemoteError].(string); ok {
+			return Payload{}, &RemoteError{Message: message}
+		}
+
+		return PayloadFromDelivery(reply.delivery), nil
+	case <-ctx.Done():
+		c.requests.forget(payload.CorrelationID)
+		return Payload{}, fmt.Errorf("failed to wait for reply: %w", ctx.Err())
+	}
+}
+
+// Serve handles the requests published on the topic (see Request), replying with what the handler returns.
+//
+// Its errors are sent back to the requester, which gets them as a *RemoteError. The context given to the handler
+// expires along with the request. Requests that expired before being handled are dropped.
+func (c *Client) Serve(
+	ctx context.Context,
+	topic string,
+	handler func(ctx context.Context, request Payload) (Payload, error),
+	opts ...StreamOption,
+) (*Stream, error) {
+	// the queue is not bound to any exchange, requests are routed to it by name
+	return c.Stream(ctx, RequestQueueName(topic), nil, func(ctx context.Context, delivery amqp091.Delivery) error {
+		if deadline, ok := requestDeadline(delivery); ok {
+			if time.Now().After(deadline) {
+				c.logger.Info("dropping expired request",
+					lf.String("topic", topic),
+					lf.String("message_id", delivery.MessageId),
+				)
+				return nil
+			}
+
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+
+		request := PayloadFromDelivery(delivery)
+		request.Topic = topic
+
+		reply, err := handler(ctx, request)
+		if delivery.ReplyTo == "" {
+			return err
+		}
+
+		publishing := reply.publishing()
+		if err != nil {
+			publishing = amqp091.Publishing{Headers: amqp091.Table{HeaderRemoteError: err.Error()}}
+		}
+		publishing.CorrelationId = delivery.CorrelationId
+		publishing.DeliveryMode = amqp091.Transient
+
+		if err := c.send(context.WithoutCancel(ctx), "", delivery.ReplyTo, publishing); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+
+		return nil
+	}, opts...)
+}
+
+func requestDeadline(delivery amqp091.Delivery) (time.Time, bool) {
+	switch v := delivery.Headers[HeaderDeadline].(type) {
+	case int64:
+		return time.UnixMilli(v), true
+	case int32:
+		return time.UnixMilli(int64(v)), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+type reply struct {
+	delivery amqp091.Delivery
+	err      error
+}
+
+// requester publishes the requests and receives their replies on a single channel, as direct reply-to requires.
+// The channel is opened on the first request, and again after being lost.
+type requester struct {
+	connection *Connection
+	mu         sync.Mutex
+	ch         *amqp091.Channel
+	pending    map[string]pendingRequest
+}
+
+type pendingRequest struct {
+	ch      *amqp091.Channel
+	replies chan reply
+}
+
+func newRequester(connection *Connection) *requester {
+	return &requester{
+		connection: connection,
+		pending:    make(map[string]pendingRequest),
+	}
+}
+
+// send publishes the request, and returns the channel its reply is given on.
+func (r *requester) send(ctx context.Context, exchange string, routingKey string, publishing amqp091.Publishing) (<-chan reply, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ch == nil || r.ch.IsClosed() {
+		if err := r.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	replies := make(chan reply, 1)
+	r.pending[publishing.CorrelationId] = pendingRequest{ch: r.ch, replies: replies}
+
+	// mandatory, so that requests nobody serves are returned instead of waiting for their deadline
+	if err := r.ch.PublishWithContext(ctx, exchange, routingKey, true, false, publishing); err != nil {
+		delete(r.pending, publishing.CorrelationId)
+		return nil, fmt.Errorf("failed to publish request: %w", err)
+	}
+
+	return replies, nil
+}
+
+// open must be called with the mutex held.
+func (r *requester) open() error {
+	ch, err := r.connection.GetChannel()
+	if err != nil {
+		return fmt.Errorf("failed to get channel: %w", err)
+	}
+
+	deliveries, err := ch.Consume(directReplyTo, "", true, false, false, false, nil)
+	if err != nil {
+		_ = ch.Close()
+		return fmt.Errorf("failed to consume replies: %w", err)
+	}
+
+	returns := ch.NotifyReturn(make(chan amqp091.Return, 16))
+	r.ch = ch
+	go r.dispatch(ch, deliveries, returns)
+	return nil
+}
+
+// dispatch hands the replies and returned requests to the pending requests, until the channel is closed.
+func (r *requester) dispatch(ch *amqp091.Channel, deliveries <-chan amqp091.Delivery, returns <-chan amqp091.Return) {
+	for deliveries != nil || returns != nil {
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				deliveries = nil
+				continue
+			}
+			r.resolve(delivery.CorrelationId, reply{delivery: delivery})
+		case returned, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			r.resolve(returned.CorrelationId, reply{err: fmt.Errorf("%w: %s", ErrUnroutable, returned.ReplyText)})
+		}
+	}
+
+	// the requests sent on the lost channel will never get their reply
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ch == ch {
+		r.ch = nil
+	}
+	for id, request := range r.pending {
+		if request.ch != ch {
+			continue
+		}
+		request.replies <- reply{err: fmt.Errorf("failed to wait for reply: %w", amqp091.ErrClosed)}
+		delete(r.pending, id)
+	}
+}
+
+func (r *requester) resolve(correlationID string, reply reply) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	request, ok := r.pending[correlationID]
+	if !ok {
+		// the request was given up on
+		return
+	}
+
+	request.replies <- reply
+	delete(r.pending, correlationID)
+}
+
+func (r *requester) forget(correlationID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, correlationID)
+}
+
+func (r *requester) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ch != nil {
+		_ = r.ch.Close()
+	}
+}